@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"io"
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/storage"
+)
+
+// archiveSnapshot reads every document a backup holds for a bucket straight
+// out of the archive with the storage reader, without going through a
+// restore. Deletions in the backup remove the key, so the snapshot is the set
+// of documents restoring the backup into an empty bucket should leave live.
+func archiveSnapshot(a *archive.Archive, repo, name, bucket string) (docSnapshot, error) {
+	reader, err := storage.OpenBucketReader(a, repo, name, bucket)
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+
+	snapshot := make(docSnapshot)
+	for {
+		doc, err := reader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+
+		key := string(doc.Key)
+		if doc.Deleted {
+			delete(snapshot, key)
+			continue
+		}
+
+		snapshot[key] = docMeta{
+			Key:      key,
+			Value:    doc.Value,
+			Flags:    doc.Flags,
+			Expiry:   doc.Expiry,
+			Datatype: doc.Datatype,
+			Cas:      doc.Cas,
+			RevSeqno: doc.RevSeqno,
+		}
+	}
+
+	return snapshot, nil
+}
+
+// verifyBackupContents reads the documents a backup holds for a bucket out of
+// the archive and fails the test if they differ from the expected documents.
+// Unlike verifying a restored bucket this catches a backup that stored bad
+// documents which a restore happened to put right, and the reverse.
+func verifyBackupContents(a *archive.Archive, repo, name, bucket string, expected docSnapshot,
+	opts verifyOptions, t *testing.T) {
+	t.Helper()
+
+	actual, err := archiveSnapshot(a, repo, name, bucket)
+	if err != nil {
+		t.Fatalf("Unable to read bucket %s from backup %s: %s", bucket, name, err.Error())
+	}
+
+	if diff := compareSnapshots(expected, actual, opts); !diff.Empty() {
+		t.Fatalf("Contents of bucket %s in backup %s do not match: %s", bucket, name,
+			diff.String())
+	}
+}
+
+// verifyBackup fails the test if the named backup does not hold exactly the
+// live keys the shadow model expects for a bucket, each with the expiry it was
+// given.
+func (m *shadowModel) verifyBackup(a *archive.Archive, repo, name, bucket string,
+	t *testing.T) {
+	t.Helper()
+
+	actual, err := archiveSnapshot(a, repo, name, bucket)
+	if err != nil {
+		t.Fatalf("Unable to read bucket %s from backup %s: %s", bucket, name, err.Error())
+	}
+
+	if diff := compareShadow(m.backupContents(bucket, name, t), actual); !diff.Empty() {
+		t.Fatalf("Bucket %s in backup %s does not match the shadow model: %s", bucket, name,
+			diff.String())
+	}
+}
@@ -0,0 +1,118 @@
+package tests
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests backing up and restoring a password protected bucket using legacy
+// SASL bucket credentials.
+func TestBackupRestoreSaslBucket(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "saslbucket")
+	bucket := env.bucket("saslbucket", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "saslpwd", t)
+
+	backupName := "sasl-auth-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, "sasl", false, t)
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	// Test bad bucket password
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, bucket, "badpassword", 4,
+		false, false)
+	requireHttpError(err, http.StatusUnauthorized, t)
+
+	// Purge anything left behind by the failed attempt
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host, bucket, "saslpwd", 4,
+		false, true)
+	checkError(err, t)
+
+	info, err := a.BackupInfo(backupName, name)
+	checkError(err, t)
+
+	if count := info[bucket].NumDocs; count != 2000 {
+		t.Fatalf("Expected to backup 2000 items, got %d", count)
+	}
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "saslpwd", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, bucket, "badpassword", "", "", 4, false,
+		config)
+	requireHttpError(err, http.StatusUnauthorized, t)
+
+	err = executeRestore(a, backupName, testCfg.Host, bucket, "saslpwd", "", "", 4, false,
+		config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
+
+// Tests backing up and restoring a bucket as an RBAC user whose roles are
+// scoped to that bucket.
+func TestBackupRestoreRBACUser(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "rbac-auth-test"
+	user := truncateBucketName(bucket + "-backup")
+	createBucketUser(testCfg.Host, user, "userpwd", []string{"data_backup[" + bucket + "]"}, t)
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, "rbac", false, t)
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	// Test bad user password
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, user, "badpassword", 4,
+		false, false)
+	requireHttpError(err, http.StatusUnauthorized, t)
+
+	// Purge anything left behind by the failed attempt
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host, user, "userpwd", 4,
+		false, true)
+	checkError(err, t)
+
+	info, err := a.BackupInfo(backupName, name)
+	checkError(err, t)
+
+	if count := info[bucket].NumDocs; count != 2000 {
+		t.Fatalf("Expected to backup 2000 items, got %d", count)
+	}
+
+	// Deleting the bucket drops the roles scoped to it, so the user has to be
+	// given the role again on the new bucket
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+	createBucketUser(testCfg.Host, user, "userpwd", []string{"data_backup[" + bucket + "]"}, t)
+
+	err = executeRestore(a, backupName, testCfg.Host, user, "badpassword", "", "", 4, false,
+		config)
+	requireHttpError(err, http.StatusUnauthorized, t)
+
+	err = executeRestore(a, backupName, testCfg.Host, user, "userpwd", "", "", 4, false, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"fmt"
+
+	"github.com/couchbase/backup/value"
+)
+
+// backupConfigBuilder builds a value.BackupConfig from named options so that
+// tests don't have to rely on the order of the positional arguments taken by
+// value.CreateBackupConfig.
+type backupConfigBuilder struct {
+	excludeBuckets      []string
+	includeBuckets      []string
+	disableBucketConfig bool
+	disableViews        bool
+	disableGSI          bool
+	disableFTS          bool
+	disableData         bool
+	vbuckets            []int
+	numVBuckets         int
+}
+
+func newBackupConfig() *backupConfigBuilder {
+	return &backupConfigBuilder{
+		excludeBuckets: make([]string, 0),
+		includeBuckets: make([]string, 0),
+		vbuckets:       []int{},
+	}
+}
+
+func (b *backupConfigBuilder) WithExcludeBuckets(buckets ...string) *backupConfigBuilder {
+	b.excludeBuckets = append(b.excludeBuckets, buckets...)
+	return b
+}
+
+func (b *backupConfigBuilder) WithIncludeBuckets(buckets ...string) *backupConfigBuilder {
+	b.includeBuckets = append(b.includeBuckets, buckets...)
+	return b
+}
+
+func (b *backupConfigBuilder) DisableBucketConfig() *backupConfigBuilder {
+	b.disableBucketConfig = true
+	return b
+}
+
+func (b *backupConfigBuilder) DisableViews() *backupConfigBuilder {
+	b.disableViews = true
+	return b
+}
+
+func (b *backupConfigBuilder) DisableGSI() *backupConfigBuilder {
+	b.disableGSI = true
+	return b
+}
+
+func (b *backupConfigBuilder) DisableFTS() *backupConfigBuilder {
+	b.disableFTS = true
+	return b
+}
+
+func (b *backupConfigBuilder) DisableData() *backupConfigBuilder {
+	b.disableData = true
+	return b
+}
+
+// WithVBuckets restricts the backup to the given vbuckets.
+func (b *backupConfigBuilder) WithVBuckets(vbuckets ...int) *backupConfigBuilder {
+	b.vbuckets = append(b.vbuckets, vbuckets...)
+	return b
+}
+
+// WithNumVBuckets sets the number of vbuckets in the buckets being backed up,
+// which the vbuckets given to WithVBuckets are checked against. The count
+// should come from bucketNumVBuckets rather than be assumed.
+func (b *backupConfigBuilder) WithNumVBuckets(n int) *backupConfigBuilder {
+	b.numVBuckets = n
+	return b
+}
+
+// Validate checks for option combinations that can never produce a useful
+// backup configuration.
+func (b *backupConfigBuilder) Validate() error {
+	if len(b.excludeBuckets) > 0 && len(b.includeBuckets) > 0 {
+		return fmt.Errorf("Include and exclude buckets cannot both be set")
+	}
+
+	if b.disableBucketConfig && b.disableViews && b.disableGSI && b.disableFTS &&
+		b.disableData {
+		return fmt.Errorf("Every backup phase is disabled, nothing would be backed up")
+	}
+
+	if len(b.vbuckets) > 0 && b.numVBuckets <= 0 {
+		return fmt.Errorf("The number of vbuckets is needed to restrict the backup to vbuckets")
+	}
+
+	seen := make(map[int]bool)
+	for _, vb := range b.vbuckets {
+		if vb < 0 || vb >= b.numVBuckets {
+			return fmt.Errorf("VBucket %d is out of range", vb)
+		} else if seen[vb] {
+			return fmt.Errorf("VBucket %d is specified more than once", vb)
+		}
+		seen[vb] = true
+	}
+
+	return nil
+}
+
+// Build validates the options and creates the backup config.
+func (b *backupConfigBuilder) Build() (*value.BackupConfig, error) {
+	if err := b.Validate(); err != nil {
+		return nil, err
+	}
+
+	return value.CreateBackupConfig("", "", b.excludeBuckets, b.includeBuckets,
+		make([]string, 0), make([]string, 0), false, b.disableBucketConfig, b.disableViews,
+		b.disableGSI, b.disableFTS, b.disableData, false, false, b.vbuckets), nil
+}
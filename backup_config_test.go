@@ -0,0 +1,88 @@
+package tests
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBackupConfigBuilderValidation(t *testing.T) {
+	_, err := newBackupConfig().WithIncludeBuckets("a").WithExcludeBuckets("b").Build()
+	if err == nil {
+		t.Fatal("Expected include and exclude buckets together to be rejected")
+	}
+
+	_, err = newBackupConfig().DisableBucketConfig().DisableViews().DisableGSI().
+		DisableFTS().DisableData().Build()
+	if err == nil {
+		t.Fatal("Expected disabling every backup phase to be rejected")
+	}
+
+	_, err = newBackupConfig().WithVBuckets(0, 1).Build()
+	if err == nil {
+		t.Fatal("Expected vbuckets without the number of vbuckets to be rejected")
+	}
+
+	_, err = newBackupConfig().WithNumVBuckets(64).WithVBuckets(0, 64).Build()
+	if err == nil {
+		t.Fatal("Expected an out of range vbucket to be rejected")
+	}
+
+	_, err = newBackupConfig().WithNumVBuckets(64).WithVBuckets(5, 5).Build()
+	if err == nil {
+		t.Fatal("Expected a duplicate vbucket to be rejected")
+	}
+
+	config, err := newBackupConfig().WithIncludeBuckets("a").DisableViews().
+		WithNumVBuckets(64).WithVBuckets(0, 1, 63).Build()
+	checkError(err, t)
+
+	if config == nil {
+		t.Fatal("Expected a backup config to be created")
+	}
+}
+
+// Tests that each Disable* option lands in the matching setting of the built
+// config, so that a mix up of the positional arguments to
+// value.CreateBackupConfig can't go unnoticed. Settings are read back from the
+// config as it is stored in the repository.
+func TestBackupConfigBuilderDisable(t *testing.T) {
+	settings := []string{"disable_bucket_config", "disable_views", "disable_gsi_indexes",
+		"disable_ft_indexes", "disable_data"}
+
+	cases := []struct {
+		name    string
+		disable func(b *backupConfigBuilder) *backupConfigBuilder
+		setting string
+	}{
+		{"BucketConfig", (*backupConfigBuilder).DisableBucketConfig, "disable_bucket_config"},
+		{"Views", (*backupConfigBuilder).DisableViews, "disable_views"},
+		{"GSI", (*backupConfigBuilder).DisableGSI, "disable_gsi_indexes"},
+		{"FTS", (*backupConfigBuilder).DisableFTS, "disable_ft_indexes"},
+		{"Data", (*backupConfigBuilder).DisableData, "disable_data"},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			config, err := c.disable(newBackupConfig()).Build()
+			checkError(err, t)
+
+			data, err := json.Marshal(config)
+			checkError(err, t)
+
+			var stored map[string]interface{}
+			checkError(json.Unmarshal(data, &stored), t)
+
+			for _, setting := range settings {
+				value, ok := stored[setting].(bool)
+				if !ok {
+					t.Fatalf("Expected backup config to have setting %s, got %s", setting,
+						string(data))
+				} else if value != (setting == c.setting) {
+					t.Fatalf("Expected %s to be %t, got %t", setting, setting == c.setting,
+						value)
+				}
+			}
+		})
+	}
+}
@@ -1,258 +1,229 @@
 package tests
 
 import (
+	"net/http"
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/couchbase/backup/archive"
-	"github.com/couchbase/backup/couchbase"
-	"github.com/couchbase/backup/value"
 )
 
 func TestBackupBadPassword(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
 
 	backupName := "badpassword-test"
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(backupName, config), t)
 
 	// Test bad password
-	_, err = executeBackup(a, backupName, "archive", testHost, rbacUsername, "badpassword",
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username, "badpassword",
 		4, false, false)
-	if err == nil {
-		t.Fatal("Backup succeeded, but expected failure")
-	}
-
-	if herr, ok := err.(couchbase.HttpError); !ok {
-		t.Fatal("Expected error to be of type HttpError")
-		if herr.Code() != 401 {
-			t.Fatal("Expected HttpError to be an authentication error")
-		}
-	}
+	requireHttpError(err, http.StatusUnauthorized, t)
 
 	// Test bad username
-	_, err = executeBackup(a, backupName, "archive", testHost, "Adminiator", rbacPassword,
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, "Adminiator", testCfg.Password,
 		4, false, false)
-	if err == nil {
-		t.Fatal("Backup succeeded, but expected failure")
-	}
-
-	if herr, ok := err.(couchbase.HttpError); !ok {
-		t.Fatal("Expected error to be of type HttpError")
-		if herr.Code() != 401 {
-			t.Fatal("Expected HttpError to be an authentication error")
-		}
-	}
+	requireHttpError(err, http.StatusUnauthorized, t)
 }
 
 func TestFullBackup(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
-	createCouchbaseBucket(testHost, "saslbucket", "saslpwd", t)
+	t.Parallel()
+	env := newTestEnv(t, "default", "saslbucket")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket", t), "saslpwd", t)
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
-	loadData(testHost, rbacUsername, rbacPassword, "saslbucket", 2500, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("saslbucket", t), 2500, "full", false, t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo("full-backup-test", config), t)
 
-	name, err := executeBackup(a, "full-backup-test", "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, "full-backup-test", "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo("full-backup-test", name)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 
-	count = info["saslbucket"].NumDocs
+	count = info[env.bucket("saslbucket", t)].NumDocs
 	if count != 2500 {
 		t.Fatal("Expected to backup 2500 items, got " + strconv.Itoa(count))
 	}
 }
 
 func TestIncrementalBackup(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	model := newShadowModel()
 
 	setName := "incr-backup-test"
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(setName, config), t)
 
 	// Do full backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
 
-	name1, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name1, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name1)
 
 	info, err := a.BackupInfo(setName, name1)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 
 	// Do first incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 4000, "incr-1-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 4000, "incr-1-", false, t)
 
-	name2, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name2, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name2)
 
 	info, err = a.BackupInfo(setName, name2)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 4000 {
 		t.Fatal("Expected to backup 4000 items, got " + strconv.Itoa(count))
 	}
 
 	// Do second incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 3000, "incr-2-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 3000, "incr-2-", false, t)
 
-	name3, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name3, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name3)
 
 	info, err = a.BackupInfo(setName, name3)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 3000 {
 		t.Fatal("Expected to backup 3000 items, got " + strconv.Itoa(count))
 	}
 
 	// Do third incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 2000, "incr-3-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 2000, "incr-3-", false, t)
 
-	name4, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name4, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name4)
 
 	info, err = a.BackupInfo(setName, name4)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 2000 {
 		t.Fatal("Expected to backup 2000 items, got " + strconv.Itoa(count))
 	}
 
+	expected := takeSnapshot(testCfg.Host, env.bucket("default", t), t)
+
 	// Restore the data without explicitly setting the start/end point in
 	// order to restore all backed up data.
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
-	err = executeRestore(a, setName, testHost, rbacUsername, rbacPassword, "",
+	err = executeRestore(a, setName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err := getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	checkError(err, t)
-
-	if items != 14000 {
-		t.Fatalf("Expected 14000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), model.restoredItems(env.bucket("default", t), "", "", t), t)
+	model.verifyRestore(testCfg.Host, env.bucket("default", t), "", "", t)
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), expected, verifyOptions{}, t)
 
 	// Restore only the 2nd and 3rd backup
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
-	err = executeRestore(a, setName, testHost, rbacUsername, rbacPassword, name2,
+	err = executeRestore(a, setName, testCfg.Host, testCfg.Username, testCfg.Password, name2,
 		name3, 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err = getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	checkError(err, t)
-
-	if items != 7000 {
-		t.Fatalf("Expected 7000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), model.restoredItems(env.bucket("default", t), name2, name3, t), t)
+	model.verifyRestore(testCfg.Host, env.bucket("default", t), name2, name3, t)
 
 	// Restore everything after and including the 3rd backup, don't specify the end
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
-	err = executeRestore(a, setName, testHost, rbacUsername, rbacPassword, name3,
+	err = executeRestore(a, setName, testCfg.Host, testCfg.Username, testCfg.Password, name3,
 		"", 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err = getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	checkError(err, t)
-
-	if items != 5000 {
-		t.Fatalf("Expected 5000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), model.restoredItems(env.bucket("default", t), name3, "", t), t)
+	model.verifyRestore(testCfg.Host, env.bucket("default", t), name3, "", t)
 
 	// Restore everything before and including the 2nd backup, don't specify start
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
-	err = executeRestore(a, setName, testHost, rbacUsername, rbacPassword, "",
+	err = executeRestore(a, setName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		name2, 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err = getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	checkError(err, t)
-
-	if items != 9000 {
-		t.Fatalf("Expected 9000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), model.restoredItems(env.bucket("default", t), "", name2, t), t)
+	model.verifyRestore(testCfg.Host, env.bucket("default", t), "", name2, t)
 }
 
 func TestBackupNoBucketsExist(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
+	t.Parallel()
+	env := newExclusiveTestEnv(t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo("full-backup-test", config), t)
 
-	name, err := executeBackup(a, "full-backup-test", "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, "full-backup-test", "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo("full-backup-test", name)
@@ -264,77 +235,74 @@ func TestBackupNoBucketsExist(t *testing.T) {
 }
 
 func TestBackupDeleteBucketBackupAgain(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
 	backupName := "backupdelbackup-test"
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "one", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "one", false, t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(backupName, config), t)
 
-	name, err := executeBackup(a, backupName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo(backupName, name)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
-	loadData(testHost, rbacUsername, rbacPassword, "default", 10000, "two", false, t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, false)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 10000, "two", false, t)
 
-	name, err = executeBackup(a, backupName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err = executeBackup(a, backupName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err = a.BackupInfo(backupName, name)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 10000 {
 		t.Fatal("Expected to backup 10000 items, got " + strconv.Itoa(count))
 	}
 }
 
 func TestBackupWithMemcachedBucket(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
-	createMemcachedBucket(testHost, "mcd", "", t)
+	t.Parallel()
+	env := newExclusiveTestEnv(t, "default", "mcd")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createMemcachedBucket(testCfg.Host, env.bucket("mcd", t), "", t)
 
 	backupName := "skip-mcd-bucket-test"
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "one", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "one", false, t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(backupName, config), t)
 
-	name, err := executeBackup(a, backupName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo(backupName, name)
@@ -344,74 +312,70 @@ func TestBackupWithMemcachedBucket(t *testing.T) {
 		t.Fatal("Expected only 1 bucket to be backed up")
 	}
 
-	if _, ok := info["default"]; !ok {
+	if _, ok := info[env.bucket("default", t)]; !ok {
 		t.Fatal("Expected default bucket to be backed up")
 	}
 }
 
 func TestBackupWithIncludeBuckets(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
-	createCouchbaseBucket(testHost, "saslbucket", "saslpwd", t)
+	t.Parallel()
+	env := newTestEnv(t, "default", "saslbucket")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket", t), "saslpwd", t)
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
-	loadData(testHost, rbacUsername, rbacPassword, "saslbucket", 2500, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("saslbucket", t), 2500, "full", false, t)
 
-	include_buckets := []string{"default"}
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		include_buckets, make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucket("default", t)).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo("full-backup-test", config), t)
 
-	name, err := executeBackup(a, "full-backup-test", "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, "full-backup-test", "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo("full-backup-test", name)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 }
 
 func TestBackupWithExcludeBuckets(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
-	createCouchbaseBucket(testHost, "saslbucket", "saslpwd", t)
+	t.Parallel()
+	env := newExclusiveTestEnv(t, "default", "saslbucket")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket", t), "saslpwd", t)
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
-	loadData(testHost, rbacUsername, rbacPassword, "saslbucket", 2500, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("saslbucket", t), 2500, "full", false, t)
 
-	exclude_buckets := []string{"default"}
-	config := value.CreateBackupConfig("", "", exclude_buckets,
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithExcludeBuckets(env.bucket("default", t)).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo("full-backup-test", config), t)
 
-	name, err := executeBackup(a, "full-backup-test", "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, "full-backup-test", "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo("full-backup-test", name)
 	checkError(err, t)
 
-	count := info["saslbucket"].NumDocs
+	count := info[env.bucket("saslbucket", t)].NumDocs
 	if count != 2500 {
 		t.Fatal("Expected to backup 2500 items, got " + strconv.Itoa(count))
 	}
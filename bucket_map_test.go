@@ -0,0 +1,155 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/value"
+)
+
+// bucketMapBackup backs up the default and saslbucket buckets and returns the
+// archive, the config used and the contents of each bucket at the time of the
+// backup keyed by the name the test asked for.
+func bucketMapBackup(env *testEnv, backupName string,
+	t *testing.T) (*archive.Archive, *value.BackupConfig, map[string]docSnapshot) {
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket", t), "saslpwd", t)
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("default", t), 3000,
+		"default-", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("saslbucket", t), 2000,
+		"sasl-", false, t)
+
+	snapshots := map[string]docSnapshot{
+		"default":    takeSnapshot(testCfg.Host, env.bucket("default", t), t),
+		"saslbucket": takeSnapshot(testCfg.Host, env.bucket("saslbucket", t), t),
+	}
+
+	config, err := newBackupConfig().
+		WithIncludeBuckets(env.bucket("default", t), env.bucket("saslbucket", t)).
+		Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	return a, config, snapshots
+}
+
+// Tests restoring two buckets into buckets with different names while an
+// unrelated bucket on the cluster is left untouched.
+func TestRestoreBucketMapRename(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "saslbucket", "default-new", "saslbucket-new", "bystander")
+	backupName := "bucket-map-rename-test"
+
+	a, config, snapshots := bucketMapBackup(env, backupName, t)
+
+	createCouchbaseBucket(testCfg.Host, env.bucket("default-new", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket-new", t), "saslpwd", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("bystander", t), "", t)
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("bystander", t), 500,
+		"bystander-", false, t)
+	bystander := takeSnapshot(testCfg.Host, env.bucket("bystander", t), t)
+
+	opts := restoreOptions{
+		BucketMap: map[string]string{
+			env.bucket("default", t):    env.bucket("default-new", t),
+			env.bucket("saslbucket", t): env.bucket("saslbucket-new", t),
+		},
+	}
+	err := executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default-new", t), 3000, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("saslbucket-new", t), 2000, t)
+
+	verifyBucketContents(testCfg.Host, env.bucket("default-new", t), snapshots["default"],
+		verifyOptions{}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("saslbucket-new", t), snapshots["saslbucket"],
+		verifyOptions{}, t)
+
+	// Neither the source buckets nor the unmapped bucket should have changed
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), snapshots["default"],
+		verifyOptions{CheckCas: true}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("saslbucket", t), snapshots["saslbucket"],
+		verifyOptions{CheckCas: true}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("bystander", t), bystander,
+		verifyOptions{CheckCas: true}, t)
+}
+
+// Tests restoring two buckets into each other.
+func TestRestoreBucketMapSwap(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "saslbucket")
+	backupName := "bucket-map-swap-test"
+
+	a, config, snapshots := bucketMapBackup(env, backupName, t)
+
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	deleteBucket(testCfg.Host, env.bucket("saslbucket", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("saslbucket", t), "saslpwd", t)
+
+	opts := restoreOptions{
+		BucketMap: map[string]string{
+			env.bucket("default", t):    env.bucket("saslbucket", t),
+			env.bucket("saslbucket", t): env.bucket("default", t),
+		},
+	}
+	err := executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 2000, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("saslbucket", t), 3000, t)
+
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), snapshots["saslbucket"],
+		verifyOptions{}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("saslbucket", t), snapshots["default"],
+		verifyOptions{}, t)
+}
+
+// Tests restoring two buckets into a single bucket.
+func TestRestoreBucketMapCombine(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "saslbucket", "combined")
+	backupName := "bucket-map-combine-test"
+
+	a, config, snapshots := bucketMapBackup(env, backupName, t)
+
+	createCouchbaseBucket(testCfg.Host, env.bucket("combined", t), "", t)
+
+	opts := restoreOptions{
+		BucketMap: map[string]string{
+			env.bucket("default", t):    env.bucket("combined", t),
+			env.bucket("saslbucket", t): env.bucket("combined", t),
+		},
+	}
+	err := executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	expected := make(docSnapshot)
+	for _, snapshot := range snapshots {
+		for key, doc := range snapshot {
+			expected[key] = doc
+		}
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("combined", t), uint64(len(expected)), t)
+	verifyBucketContents(testCfg.Host, env.bucket("combined", t), expected, verifyOptions{}, t)
+}
@@ -0,0 +1,201 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Eviction policies of ephemeral buckets.
+const (
+	evictionNone = "noEviction"
+	evictionNRU  = "nruEviction"
+)
+
+// bucketSettings are the settings of a bucket as reported by the cluster
+// manager.
+type bucketSettings struct {
+	BucketType             string `json:"bucketType"`
+	EvictionPolicy         string `json:"evictionPolicy"`
+	ReplicaNumber          int    `json:"replicaNumber"`
+	ReplicaIndex           bool   `json:"replicaIndex"`
+	ConflictResolutionType string `json:"conflictResolutionType"`
+	CompressionMode        string `json:"compressionMode"`
+	MaxTTL                 int    `json:"maxTTL"`
+	DurabilityMinLevel     string `json:"durabilityMinLevel"`
+	Quota                  struct {
+		RAM int64 `json:"rawRAM"`
+	} `json:"quota"`
+	Controllers struct {
+		Flush string `json:"flush"`
+	} `json:"controllers"`
+}
+
+func (s bucketSettings) FlushEnabled() bool {
+	return s.Controllers.Flush != ""
+}
+
+// diff returns a description of every setting that differs between the
+// expected and actual settings.
+func (s bucketSettings) diff(actual bucketSettings) []string {
+	diffs := make([]string, 0)
+	check := func(name string, expected, actual interface{}) {
+		if expected != actual {
+			diffs = append(diffs, fmt.Sprintf("%s expected %v, got %v", name, expected, actual))
+		}
+	}
+
+	check("bucket type", s.BucketType, actual.BucketType)
+	check("eviction policy", s.EvictionPolicy, actual.EvictionPolicy)
+	check("replica number", s.ReplicaNumber, actual.ReplicaNumber)
+	check("replica index", s.ReplicaIndex, actual.ReplicaIndex)
+	check("conflict resolution type", s.ConflictResolutionType, actual.ConflictResolutionType)
+	check("compression mode", s.CompressionMode, actual.CompressionMode)
+	check("max TTL", s.MaxTTL, actual.MaxTTL)
+	check("durability minimum level", s.DurabilityMinLevel, actual.DurabilityMinLevel)
+	check("RAM quota", s.Quota.RAM, actual.Quota.RAM)
+	check("flush enabled", s.FlushEnabled(), actual.FlushEnabled())
+
+	return diffs
+}
+
+// createEphemeralBucket creates an ephemeral bucket with the given eviction
+// policy. The gocb cluster manager can't set eviction policies, so the bucket
+// is created through the REST API.
+func createEphemeralBucket(host, bucket, password, eviction string, t *testing.T) {
+	form := url.Values{}
+	form.Set("name", bucket)
+	form.Set("bucketType", "ephemeral")
+	form.Set("evictionPolicy", eviction)
+	form.Set("ramQuotaMB", "256")
+	form.Set("replicaNumber", "0")
+	form.Set("authType", "sasl")
+	form.Set("saslPassword", password)
+	form.Set("flushEnabled", "0")
+
+	createBucketWithForm(host, form, t)
+}
+
+// createMaxTTLBucket creates a couchbase bucket whose documents live for at
+// most maxTTL.
+func createMaxTTLBucket(host, bucket string, maxTTL time.Duration, t *testing.T) {
+	form := url.Values{}
+	form.Set("name", bucket)
+	form.Set("bucketType", "couchbase")
+	form.Set("ramQuotaMB", "256")
+	form.Set("replicaNumber", "0")
+	form.Set("maxTTL", strconv.Itoa(int(maxTTL.Seconds())))
+	form.Set("authType", "sasl")
+	form.Set("saslPassword", "")
+	form.Set("flushEnabled", "0")
+
+	createBucketWithForm(host, form, t)
+}
+
+// clusterTopology describes the parts of a cluster which decide the bucket
+// settings it accepts.
+type clusterTopology struct {
+	Enterprise bool
+	Nodes      int
+	// Major and minor version of the server, for example 6 and 6 for 6.6.0
+	Version [2]int
+}
+
+// atLeast reports whether the cluster runs at least the given server version.
+func (c clusterTopology) atLeast(major, minor int) bool {
+	return c.Version[0] > major || (c.Version[0] == major && c.Version[1] >= minor)
+}
+
+// getClusterTopology reads the edition, size and version of the cluster.
+func getClusterTopology(host string, t *testing.T) clusterTopology {
+	get := func(path string, data interface{}) {
+		req, err := http.NewRequest("GET", host+path, nil)
+		checkError(err, t)
+		req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+		resp, err := http.DefaultClient.Do(req)
+		checkError(err, t)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("Getting %s returned %d", path, resp.StatusCode)
+		}
+		checkError(json.NewDecoder(resp.Body).Decode(data), t)
+	}
+
+	var pools struct {
+		IsEnterprise          bool   `json:"isEnterprise"`
+		ImplementationVersion string `json:"implementationVersion"`
+	}
+	get("/pools", &pools)
+
+	var pool struct {
+		Nodes []interface{} `json:"nodes"`
+	}
+	get("/pools/default", &pool)
+
+	topology := clusterTopology{Enterprise: pools.IsEnterprise, Nodes: len(pool.Nodes)}
+
+	// Versions look like 6.6.0-7909-enterprise
+	parts := strings.SplitN(pools.ImplementationVersion, ".", 3)
+	for i := 0; i < len(parts) && i < len(topology.Version); i++ {
+		topology.Version[i], _ = strconv.Atoi(parts[i])
+	}
+
+	return topology
+}
+
+func createBucketWithForm(host string, form url.Values, t *testing.T) {
+	req, err := http.NewRequest("POST", host+"/pools/default/buckets",
+		strings.NewReader(form.Encode()))
+	checkError(err, t)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusAccepted {
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		t.Fatalf("Bucket creation failed with status %d: %v", resp.StatusCode, body)
+	}
+
+	waitForBucketHealthy(host, form.Get("name"), t)
+}
+
+// getBucketSettings reads the settings of a bucket from the cluster manager.
+func getBucketSettings(host, bucket string, t *testing.T) bucketSettings {
+	req, err := http.NewRequest("GET", host+"/pools/default/buckets/"+bucket, nil)
+	checkError(err, t)
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Getting settings of bucket %s returned %d", bucket, resp.StatusCode)
+	}
+
+	var settings bucketSettings
+	checkError(json.NewDecoder(resp.Body).Decode(&settings), t)
+
+	return settings
+}
+
+// verifyBucketSettings fails the test if the settings of the bucket differ
+// from the expected settings.
+func verifyBucketSettings(host, bucket string, expected bucketSettings, t *testing.T) {
+	t.Helper()
+
+	if diffs := expected.diff(getBucketSettings(host, bucket, t)); len(diffs) > 0 {
+		t.Fatalf("Settings of bucket %s do not match: %s", bucket, strings.Join(diffs, ", "))
+	}
+}
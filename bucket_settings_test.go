@@ -1,95 +1,186 @@
 package tests
 
 import (
+	"net/url"
 	"strconv"
+	"strings"
 	"testing"
 
 	"github.com/couchbase/backup/archive"
-	"github.com/couchbase/backup/couchbase"
-	"github.com/couchbase/backup/value"
 )
 
 // Tests all error cases when we don't have a bucket and try to restore. This
 // means that we check that all restore configuratoins work no matter what is
 // skipped during the restore.
 func TestRestoreNoBucketNoBackupConfig(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
 	backupName := "bucket-config-test"
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
-	loadViews(testHost, "default", "first", 12, 2, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
+	loadViews(testCfg.Host, env.bucket("default", t), "first", 12, 2, t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, true, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().
+		WithIncludeBuckets(env.bucketNames()...).
+		DisableBucketConfig().
+		Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(backupName, config), t)
 
 	// Backup the data
-	name, err := executeBackup(a, backupName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo(backupName, name)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 
-	deleteBucket(testHost, "default", t, true)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
 
 	// Do a restore where the views are the first thing to be restored, make sure
 	// we fail to restore the views because no bucket exists
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "",
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
-	_, ok := err.(couchbase.BucketNotFoundError)
-	if err == nil || !ok {
-		t.Fatal("Expected BucketNotFoundError")
-	}
+	requireBucketNotFound(err, t)
 
 	// Do a restore where the gsi indexes are the first thing to be restored, make
 	// sure we fail to restore the gsi indexes because no bucket exists
-	config = value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, true, true, false, false, false, false, false, []int{})
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "",
+	config, err = newBackupConfig().
+		WithIncludeBuckets(env.bucketNames()...).
+		DisableBucketConfig().
+		DisableViews().
+		Build()
+	checkError(err, t)
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
-	_, ok = err.(couchbase.BucketNotFoundError)
-	if err == nil || !ok {
-		t.Fatal("Expected BucketNotFoundError")
-	}
+	requireBucketNotFound(err, t)
 
 	// Do a restore where the full text indexes are the first thing to be restored,
 	// make sure we fail to restore the full text indexes because no bucket exists
-	config = value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, true, true, true, false, false, false, false, []int{})
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "",
+	config, err = newBackupConfig().
+		WithIncludeBuckets(env.bucketNames()...).
+		DisableBucketConfig().
+		DisableViews().
+		DisableGSI().
+		Build()
+	checkError(err, t)
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
-	_, ok = err.(couchbase.BucketNotFoundError)
-	if err == nil || !ok {
-		t.Fatal("Expected BucketNotFoundError")
-	}
+	requireBucketNotFound(err, t)
 
 	// Do a restore where data is the first thing to be restored, make sure we fail
 	// to restore the data because no bucket exists
-	config = value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, true, true, true, true, false, false, false, []int{})
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "",
+	config, err = newBackupConfig().
+		WithIncludeBuckets(env.bucketNames()...).
+		DisableBucketConfig().
+		DisableViews().
+		DisableGSI().
+		DisableFTS().
+		Build()
+	checkError(err, t)
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
-	_, ok = err.(couchbase.BucketNotFoundError)
-	if err == nil || !ok {
-		t.Fatal("Expected BucketNotFoundError")
+	requireBucketNotFound(err, t)
+}
+
+// Tests that every bucket setting captured by the backup is recreated when the
+// bucket config is restored into a cluster without the bucket.
+func TestBucketSettingsRoundTrip(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+
+	// Use non-default values for every setting the cluster accepts so that a
+	// setting which isn't restored can't match by accident. A single node can't
+	// hold replicas, only the Enterprise Edition can change the conflict
+	// resolution type and compression mode and only 6.6 and later servers have
+	// a minimum durability level.
+	topology := getClusterTopology(testCfg.Host, t)
+	durability := topology.atLeast(6, 6)
+	replicas := topology.Nodes - 1
+	if replicas > 2 {
+		replicas = 2
+	}
+
+	form := url.Values{}
+	form.Set("name", bucket)
+	form.Set("bucketType", "couchbase")
+	form.Set("ramQuotaMB", "300")
+	form.Set("replicaNumber", strconv.Itoa(replicas))
+	form.Set("replicaIndex", "1")
+	form.Set("evictionPolicy", "fullEviction")
+	form.Set("maxTTL", "3600")
+	form.Set("flushEnabled", "1")
+	form.Set("authType", "sasl")
+	form.Set("saslPassword", "")
+	if durability {
+		form.Set("durabilityMinLevel", "majority")
+	}
+	if topology.Enterprise {
+		form.Set("conflictResolutionType", "lww")
+		form.Set("compressionMode", "active")
+	}
+	createBucketWithForm(testCfg.Host, form, t)
+
+	backupName := "bucket-settings-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "settings", false,
+		t)
+	expected := getBucketSettings(testCfg.Host, bucket, t)
+
+	// Make sure the bucket was created as asked, otherwise the round trip could
+	// pass by restoring settings nobody set. The cluster reports couchbase
+	// buckets as membase buckets.
+	posted := expected
+	posted.BucketType = "membase"
+	posted.EvictionPolicy = form.Get("evictionPolicy")
+	posted.ReplicaNumber = replicas
+	posted.ReplicaIndex = true
+	posted.MaxTTL = 3600
+	posted.Quota.RAM = 300 * 1024 * 1024
+	if durability {
+		posted.DurabilityMinLevel = form.Get("durabilityMinLevel")
+	}
+	if topology.Enterprise {
+		posted.ConflictResolutionType = form.Get("conflictResolutionType")
+		posted.CompressionMode = form.Get("compressionMode")
 	}
+	if diffs := posted.diff(expected); len(diffs) > 0 || !expected.FlushEnabled() {
+		t.Fatalf("Bucket %s was not created with the posted settings: %s, flush enabled %t",
+			bucket, strings.Join(diffs, ", "), expected.FlushEnabled())
+	}
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForBucketHealthy(testCfg.Host, bucket, t)
+	verifyBucketSettings(testCfg.Host, bucket, expected, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
 }
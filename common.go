@@ -2,14 +2,20 @@ package tests
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"path/filepath"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
-	"time"
 
 	"github.com/couchbase/backup"
 	"github.com/couchbase/backup/archive"
@@ -20,13 +26,145 @@ import (
 	"github.com/couchbase/gocb"
 )
 
-const testDir string = "/tmp/backup-test"
-const testHost = "http://127.0.0.1:9000"
-const rbacUsername = "Administrator"
-const rbacPassword = "password"
+// clusterLease is held shared by tests that only touch their own buckets and
+// exclusively by tests that need to see, or wipe, every bucket on the cluster.
+var clusterLease sync.RWMutex
+
+// bucketLeases limits how many buckets the tests running in parallel may have
+// on the cluster at once.
+var bucketLeases struct {
+	once  sync.Once
+	mutex sync.Mutex
+	cond  *sync.Cond
+	free  int
+}
+
+func acquireBuckets(n int, t *testing.T) {
+	bucketLeases.once.Do(func() {
+		bucketLeases.cond = sync.NewCond(&bucketLeases.mutex)
+		bucketLeases.free = testCfg.MaxBuckets
+	})
 
-func cleanup() {
-	os.RemoveAll(testDir)
+	if n > testCfg.MaxBuckets {
+		t.Fatalf("Test needs %d buckets but at most %d may exist", n, testCfg.MaxBuckets)
+	}
+
+	bucketLeases.mutex.Lock()
+	for bucketLeases.free < n {
+		bucketLeases.cond.Wait()
+	}
+	bucketLeases.free -= n
+	bucketLeases.mutex.Unlock()
+}
+
+func releaseBuckets(n int) {
+	bucketLeases.mutex.Lock()
+	bucketLeases.free += n
+	bucketLeases.cond.Broadcast()
+	bucketLeases.mutex.Unlock()
+}
+
+// testEnv is the per-test view of the cluster and the file system. Every test
+// gets its own archive directory and bucket names prefixed with the test name
+// so that tests can run in parallel against a single cluster.
+type testEnv struct {
+	archive string
+	buckets map[string]string
+}
+
+// newTestEnv leases the named buckets for the duration of the test. Any stale
+// buckets left behind by a previous run are removed first and the buckets are
+// deleted again when the test completes.
+func newTestEnv(t *testing.T, buckets ...string) *testEnv {
+	// Each lease is released by its own cleanup as soon as it is held, so a test
+	// that fails while setting up can't leave the cluster leased
+	clusterLease.RLock()
+	t.Cleanup(clusterLease.RUnlock)
+
+	acquireBuckets(len(buckets), t)
+	t.Cleanup(func() { releaseBuckets(len(buckets)) })
+
+	env := createTestEnv(t, buckets)
+	t.Cleanup(func() {
+		for _, name := range env.buckets {
+			deleteBucket(testCfg.Host, name, t, true)
+		}
+	})
+
+	for _, name := range env.buckets {
+		deleteBucket(testCfg.Host, name, t, true)
+	}
+
+	return env
+}
+
+// newExclusiveTestEnv waits until no other test is using the cluster and then
+// starts the test with no buckets on the cluster at all.
+func newExclusiveTestEnv(t *testing.T, buckets ...string) *testEnv {
+	clusterLease.Lock()
+	t.Cleanup(clusterLease.Unlock)
+
+	env := createTestEnv(t, buckets)
+	t.Cleanup(func() { deleteAllBuckets(testCfg.Host, t) })
+
+	deleteAllBuckets(testCfg.Host, t)
+
+	return env
+}
+
+func createTestEnv(t *testing.T, buckets []string) *testEnv {
+	prefix := strings.TrimPrefix(t.Name(), "Test")
+	prefix = strings.Map(func(r rune) rune {
+		if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+			r == '-' || r == '_' || r == '.' {
+			return r
+		}
+		return '_'
+	}, prefix)
+
+	env := &testEnv{buckets: make(map[string]string)}
+	for _, name := range buckets {
+		env.buckets[name] = truncateBucketName(prefix + "-" + name)
+	}
+
+	if testCfg.ArchiveDir == "" {
+		env.archive = t.TempDir()
+	} else {
+		env.archive = filepath.Join(testCfg.ArchiveDir, prefix)
+		os.RemoveAll(env.archive)
+		t.Cleanup(func() { os.RemoveAll(env.archive) })
+	}
+
+	return env
+}
+
+// Bucket names are limited to 100 characters.
+func truncateBucketName(name string) string {
+	if len(name) > 100 {
+		return name[len(name)-100:]
+	}
+	return name
+}
+
+// bucket returns the name the test should use on the cluster for the bucket
+// it asked for when the environment was created.
+func (e *testEnv) bucket(name string, t *testing.T) string {
+	real, ok := e.buckets[name]
+	if !ok {
+		t.Fatalf("Bucket %s was not leased by the test", name)
+	}
+	return real
+}
+
+// bucketNames returns the cluster names of all of the buckets leased by the
+// test, suitable for restricting a backup to this test's buckets.
+func (e *testEnv) bucketNames() []string {
+	names := make([]string, 0, len(e.buckets))
+	for _, name := range e.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
 }
 
 func checkError(err error, t *testing.T) {
@@ -40,89 +178,142 @@ func checkError(err error, t *testing.T) {
 	}
 }
 
-func executeBackup(a *archive.Archive, name, sink, host, user, pwd string, threads int,
-	resume, purge bool) (string, error) {
-	t, err := backup.CouchbaseToArchiveTransferable(a, name, host, user, pwd, "",
-		(string)(plan.COMPRESSION_POLICY_UNCHANGED), threads, resume, purge, nil,
-		storage.DefaultStorageConfig())
-	if err != nil {
-		return "", err
+// requireHttpError fails the test unless err is, or wraps, an HttpError with
+// the given status code.
+func requireHttpError(err error, code int, t *testing.T) {
+	t.Helper()
+
+	var herr couchbase.HttpError
+	if !errors.As(err, &herr) {
+		failWrongError("HttpError", err, t)
 	}
 
-	err = t.Execute()
-	return t.Name(), err
+	if int(herr.Code()) != code {
+		t.Fatalf("Expected HttpError with status %d, got status %d: %s", code, herr.Code(),
+			err.Error())
+	}
 }
 
-func executeRestore(a *archive.Archive, name, host, user, pwd, start, end string, threads int,
-	force bool, config *value.BackupConfig) error {
-	t, err := backup.ArchiveToCouchbaseTransferable(a, name, host, user, pwd, start, end, "",
-		threads, false, false, make(map[string]string), "none", 0, nil, config)
-	for _, restore := range t {
-		err = restore.Execute()
-		if err != nil {
-			return err
-		}
+// requireBucketNotFound fails the test unless err is, or wraps, a
+// BucketNotFoundError.
+func requireBucketNotFound(err error, t *testing.T) {
+	t.Helper()
+
+	var berr couchbase.BucketNotFoundError
+	if !errors.As(err, &berr) {
+		failWrongError("BucketNotFoundError", err, t)
 	}
-	return err
 }
 
-func loadData(host, username, password, bucket string, items int,
-	prefix string, delete bool, t *testing.T) {
-	connection, err := gocb.Connect(host)
-	if err != nil {
-		t.Fatal("Test data loader cannot connect to the cluster: " + err.Error())
+// requireEmptyRange fails the test unless err is, or wraps, an EmptyRangeError.
+func requireEmptyRange(err error, t *testing.T) {
+	t.Helper()
+
+	var rerr archive.EmptyRangeError
+	if !errors.As(err, &rerr) {
+		failWrongError("EmptyRangeError", err, t)
 	}
+}
 
-	connection.Authenticate(gocb.PasswordAuthenticator{
-		Username: username,
-		Password: password,
-	})
+// requireRangePoint fails the test unless err is, or wraps, a RangePointError.
+func requireRangePoint(err error, t *testing.T) {
+	t.Helper()
+
+	var rerr archive.RangePointError
+	if !errors.As(err, &rerr) {
+		failWrongError("RangePointError", err, t)
+	}
+}
 
-	b, err := connection.OpenBucket(bucket, "")
+func failWrongError(expected string, err error, t *testing.T) {
+	t.Helper()
+
+	if err == nil {
+		t.Fatalf("Expected %s, but the operation succeeded", expected)
+	}
+	t.Fatalf("Expected %s, got %T: %s", expected, err, err.Error())
+}
+
+func executeBackup(a *archive.Archive, name, sink, host, user, pwd string, threads int,
+	resume, purge bool) (string, error) {
+	return executeConfiguredBackup(a, name, sink, host, user, pwd,
+		(string)(plan.COMPRESSION_POLICY_UNCHANGED), storage.DefaultStorageConfig(), threads,
+		resume, purge)
+}
+
+// executeConfiguredBackup runs a backup which stores documents according to
+// the given plan compression policy and storage config.
+func executeConfiguredBackup(a *archive.Archive, name, sink, host, user, pwd,
+	compression string, config *storage.StorageConfig, threads int, resume,
+	purge bool) (string, error) {
+	t, err := backup.CouchbaseToArchiveTransferable(a, name, host, user, pwd, "", compression,
+		threads, resume, purge, nil, config)
 	if err != nil {
-		t.Fatal("Test data loader cannot connect to the bucket: " + err.Error())
+		return "", err
 	}
 
-	for i := 0; i < items; i++ {
-		key := prefix + strconv.Itoa(i)
-		if delete {
-			_, err := b.Remove(key, 0)
-			if err != nil {
-				t.Fatal("Error deleting `" + key + "`, " + err.Error())
-			}
-		} else {
-			_, err := b.Insert(key, map[string]interface{}{"x": i}, 0)
+	err = t.Execute()
+	return t.Name(), err
+}
+
+// backupSize returns the number of bytes a backup occupies on disk.
+func backupSize(archiveDir, repo, name string, t *testing.T) int64 {
+	var size int64
+	err := filepath.Walk(filepath.Join(archiveDir, repo, name),
+		func(path string, info os.FileInfo, err error) error {
 			if err != nil {
-				t.Fatal("Error setting `" + key + "`, " + err.Error())
+				return err
+			} else if !info.IsDir() {
+				size += info.Size()
 			}
-		}
-	}
+			return nil
+		})
+	checkError(err, t)
 
-	b.Close()
+	return size
 }
 
-func loadViews(host, bucket, prefix string, numDDocs, numViews int, t *testing.T) {
-	rest := couchbase.CreateRestClient(testHost, rbacUsername, rbacPassword, nil)
-	ddocs := make([]value.DDoc, 0)
+// abandonBackup runs a backup which is interrupted by the one fault armed on the
+// mock cluster and returns the name of the partially written backup it leaves
+// in the repository.
+func abandonBackup(mc *mockCluster, a *archive.Archive, name string, t *testing.T) string {
+	t.Helper()
+
+	partial, err := executeBackup(a, name, "archive", mc.URL(), testCfg.Username,
+		testCfg.Password, 4, false, false)
+	if fired := mc.faultsFired(); fired != 1 {
+		t.Fatalf("Expected the injected fault to fire once, fired %d times", fired)
+	} else if err == nil {
+		t.Fatal("Backup succeeded, but expected it to be interrupted")
+	}
 
-	for i := 0; i < numDDocs; i++ {
-		dname := "_design/" + prefix + "_" + strconv.Itoa(i)
-		views := make(map[string]map[string]map[string]string)
-		views["views"] = make(map[string]map[string]string)
+	return partial
+}
 
-		for j := 0; j < numViews; j++ {
-			vname := "generated_views_" + strconv.Itoa(j)
-			views["views"][vname] = make(map[string]string)
-			views["views"][vname]["map"] = "function (doc, meta) {\n emit(meta.id, null);\n}"
-		}
+func executeRestore(a *archive.Archive, name, host, user, pwd, start, end string, threads int,
+	force bool, config *value.BackupConfig) error {
+	opts := restoreOptions{Start: start, End: end, Threads: threads, ForceUpdates: force}
+	return executeRestoreWithOptions(a, name, host, user, pwd, opts, config)
+}
 
-		ddocs = append(ddocs, value.DDoc{dname, "xxxxx", views})
+// loadData inserts, or deletes, the documents prefix0 to prefix<items-1>.
+func loadData(host, username, password, bucket string, items int,
+	prefix string, delete bool, t *testing.T) {
+	mode := loadInsert
+	if delete {
+		mode = loadRemove
 	}
 
-	err := rest.PutViews(bucket, ddocs)
-	if err != nil {
-		t.Fatal(err.Error())
-	}
+	bulkLoad(host, username, password, bucket, items, prefix, loadOptions{Mode: mode}, t)
+}
+
+// loadViews creates the design documents prefix_0 to prefix_<numDDocs-1> with
+// numViews views each and returns them.
+func loadViews(host, bucket, prefix string, numDDocs, numViews int, t *testing.T) designDocs {
+	ddocs := generatedDDocs(prefix, numDDocs, numViews)
+	putDesignDocs(host, bucket, ddocs, t)
+
+	return ddocs
 }
 
 func createMemcachedBucket(host, bucket, password string, t *testing.T) {
@@ -144,6 +335,7 @@ func createCouchbaseBucket(host, bucket, password string, t *testing.T) {
 		FlushEnabled:  false,
 		IndexReplicas: false,
 		Name:          bucket,
+		Password:      password,
 		Quota:         256,
 		Replicas:      0,
 		Type:          gocb.Couchbase,
@@ -159,41 +351,177 @@ func createBucket(host string, settings *gocb.BucketSettings, t *testing.T) {
 		t.Fatal("Unable to connect to cluster: " + err.Error())
 	}
 
-	manager := connection.Manager("Administrator", "password")
+	manager := connection.Manager(testCfg.Username, testCfg.Password)
 	err = manager.InsertBucket(settings)
 	if err != nil {
 		t.Fatal("Bucket creation failed: " + err.Error())
 	}
 
-	for i := 0; i < 30; i++ {
-		if isBucketReady(host, settings.Name, t) {
-			return
+	waitForBucketHealthy(host, settings.Name, t)
+}
+
+// createBucketUser creates a local RBAC user with the given roles, for example
+// data_backup[bucket]. The user is deleted again when the test completes.
+func createBucketUser(host, user, password string, roles []string, t *testing.T) {
+	form := url.Values{}
+	form.Set("password", password)
+	form.Set("roles", strings.Join(roles, ","))
+
+	if status := rbacUserRequest(host, "PUT", user, form, t); status != http.StatusOK {
+		t.Fatalf("Creating user %s returned %d", user, status)
+	}
+
+	t.Cleanup(func() {
+		rbacUserRequest(host, "DELETE", user, nil, t)
+	})
+}
+
+func rbacUserRequest(host, method, user string, form url.Values, t *testing.T) int {
+	req, err := http.NewRequest(method, host+"/settings/rbac/users/local/"+user,
+		strings.NewReader(form.Encode()))
+	checkError(err, t)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	resp.Body.Close()
+
+	return resp.StatusCode
+}
+
+// bucketNumVBuckets returns the number of vbuckets in the bucket as given by its
+// vbucket map. Clusters can be configured with fewer than the usual 1024.
+func bucketNumVBuckets(host, bucket string, t *testing.T) int {
+	_, vbmap, err := bucketVBucketMap(host, testCfg.Username, testCfg.Password, bucket)
+	checkError(err, t)
+
+	return len(vbmap)
+}
+
+// requireCbcompact returns the path of the cbcompact binary, skipping the test
+// if it isn't installed or the cluster is the mock, whose data service can't be
+// compacted.
+func requireCbcompact(t *testing.T) string {
+	if testCfg.ClusterType == clusterTypeMock {
+		t.Skip("The mock data service can't be compacted")
+	}
+
+	path, err := exec.LookPath(testCfg.CbcompactPath)
+	if err != nil {
+		t.Skipf("No cbcompact binary: %s", err.Error())
+	}
+
+	return path
+}
+
+// The names nodes give the TLS ports of their services, which serviceURL uses
+// for https hosts.
+var sslServices = map[string]string{
+	"mgmt":      "mgmtSSL",
+	"capi":      "capiSSL",
+	"kv":        "kvSSL",
+	"n1ql":      "n1qlSSL",
+	"fts":       "ftsSSL",
+	"indexHttp": "indexHttps",
+	"cbas":      "cbasSSL",
+}
+
+// serviceURL returns the address of the first node running the given service,
+// for example n1ql or fts, or an empty string if no node runs it. For https
+// hosts the address is that of the service's TLS port.
+func serviceURL(host, service string, t *testing.T) string {
+	req, err := http.NewRequest("GET", host+"/pools/default/nodeServices", nil)
+	checkError(err, t)
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Getting node services returned %d", resp.StatusCode)
+	}
+
+	type overlay struct {
+		NodesExt []struct {
+			Hostname string         `json:"hostname"`
+			Services map[string]int `json:"services"`
+		} `json:"nodesExt"`
+	}
+
+	var data overlay
+	checkError(json.NewDecoder(resp.Body).Decode(&data), t)
+
+	u, err := url.Parse(host)
+	checkError(err, t)
+
+	if ssl, ok := sslServices[service]; ok && u.Scheme == "https" {
+		service = ssl
+	}
+
+	for _, node := range data.NodesExt {
+		port, ok := node.Services[service]
+		if !ok {
+			continue
+		}
+
+		// Single node clusters leave the hostname out
+		hostname := node.Hostname
+		if hostname == "" {
+			hostname = u.Hostname()
 		}
-		time.Sleep(1 * time.Second)
+
+		return u.Scheme + "://" + net.JoinHostPort(hostname, strconv.Itoa(port))
 	}
 
-	t.Fatal("Bucket creation timed out")
+	return ""
 }
 
 func isBucketReady(host, bucket string, t *testing.T) bool {
+	statuses, err := bucketNodeStatus(host, bucket)
+	if err != nil {
+		t.Fatalf("Error getting bucket status: %s", err.Error())
+	}
+
+	if len(statuses) == 0 {
+		return false
+	}
+
+	for _, status := range statuses {
+		if status != "healthy" {
+			return false
+		}
+	}
+
+	return true
+}
+
+// bucketNodeStatus returns the status of each node serving the bucket, or nil
+// if the bucket does not exist.
+func bucketNodeStatus(host, bucket string) ([]string, error) {
 	url := "/pools/default/buckets/" + bucket
 
 	req, err := http.NewRequest("GET", host+url, nil)
 	if err != nil {
-		t.Fatalf("Failed to create http request: %s", err.Error())
+		return nil, err
 	}
-	req.SetBasicAuth("Administrator", "password")
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
 
 	client := http.Client{}
 	resp, err := client.Do(req)
 	if err != nil {
-		t.Fatalf("Error sending http request: %s", err.Error())
-	} else if resp.StatusCode != http.StatusOK {
-		return false
+		return nil, err
 	}
 
 	defer resp.Body.Close()
 
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	} else if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Getting bucket %s returned %d", bucket, resp.StatusCode)
+	}
+
 	type overlay struct {
 		Name  string `json:"name"`
 		Nodes []struct {
@@ -204,24 +532,15 @@ func isBucketReady(host, bucket string, t *testing.T) bool {
 	var data overlay
 	decoder := json.NewDecoder(resp.Body)
 	if err = decoder.Decode(&data); err != nil {
-		t.Fatalf("Error decoding response: %s", err.Error())
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return false
-	}
-
-	if len(data.Nodes) == 0 {
-		return false
+		return nil, err
 	}
 
+	statuses := make([]string, 0, len(data.Nodes))
 	for _, node := range data.Nodes {
-		if node.Status != "healthy" {
-			return false
-		}
+		statuses = append(statuses, node.Status)
 	}
 
-	return true
+	return statuses, nil
 }
 
 func deleteAllBuckets(host string, t *testing.T) {
@@ -231,11 +550,11 @@ func deleteAllBuckets(host string, t *testing.T) {
 	}
 
 	connection.Authenticate(gocb.PasswordAuthenticator{
-		Username: rbacUsername,
-		Password: rbacPassword,
+		Username: testCfg.Username,
+		Password: testCfg.Password,
 	})
 
-	manager := connection.Manager(rbacUsername, rbacPassword)
+	manager := connection.Manager(testCfg.Username, testCfg.Password)
 	buckets, err := manager.GetBuckets()
 	if err != nil {
 		t.Fatal("Unable to get all buckets: " + err.Error())
@@ -254,7 +573,7 @@ func deleteBucket(host string, bucket string, t *testing.T, noErr bool) {
 		t.Fatal("Unable to connect to cluster: " + err.Error())
 	}
 
-	manager := connection.Manager("Administrator", "password")
+	manager := connection.Manager(testCfg.Username, testCfg.Password)
 	if err := manager.RemoveBucket(bucket); err != nil && !noErr {
 		t.Fatalf("Error deleting bucket %s", bucket)
 	}
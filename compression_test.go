@@ -0,0 +1,86 @@
+package tests
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/plan"
+	"github.com/couchbase/backup/storage"
+)
+
+// Backs up the same compressible data under every compression policy,
+// restores each backup and checks the restored documents match the originals.
+// Compressed backups are expected to be smaller on disk than uncompressed ones.
+func TestBackupCompressionPolicies(t *testing.T) {
+	policies := []string{
+		(string)(plan.COMPRESSION_POLICY_UNCHANGED),
+		(string)(plan.COMPRESSION_POLICY_COMPRESSED),
+		(string)(plan.COMPRESSION_POLICY_UNCOMPRESSED),
+	}
+
+	var mutex sync.Mutex
+	sizes := make(map[string]int64)
+
+	t.Run("policies", func(t *testing.T) {
+		for _, policy := range policies {
+			policy := policy
+			t.Run(policy, func(t *testing.T) {
+				t.Parallel()
+				env := newTestEnv(t, "default")
+				bucket := env.bucket("default", t)
+				createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+				backupName := "compression-test"
+
+				opts := loadOptions{Mode: loadInsert, DocSize: 4096}
+				bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000,
+					"compress", opts, t)
+				expected := takeSnapshot(testCfg.Host, bucket, t)
+
+				config, err := newBackupConfig().
+					WithIncludeBuckets(env.bucketNames()...).
+					Build()
+				checkError(err, t)
+
+				a, err := archive.MountArchive(env.archive, true)
+				checkError(err, t)
+
+				checkError(a.CreateRepo(backupName, config), t)
+
+				name, err := executeConfiguredBackup(a, backupName, "archive", testCfg.Host,
+					testCfg.Username, testCfg.Password, policy, storage.DefaultStorageConfig(), 4,
+					false, false)
+				checkError(err, t)
+
+				mutex.Lock()
+				sizes[policy] = backupSize(env.archive, backupName, name, t)
+				mutex.Unlock()
+
+				verifyBackupContents(a, backupName, name, bucket, expected, verifyOptions{}, t)
+
+				deleteBucket(testCfg.Host, bucket, t, true)
+				createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+				err = executeRestore(a, backupName, testCfg.Host, testCfg.Username,
+					testCfg.Password, "", "", 4, false, config)
+				checkError(err, t)
+
+				waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000,
+					t)
+				verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+			})
+		}
+	})
+
+	if t.Failed() {
+		return
+	}
+
+	compressed := sizes[(string)(plan.COMPRESSION_POLICY_COMPRESSED)]
+	uncompressed := sizes[(string)(plan.COMPRESSION_POLICY_UNCOMPRESSED)]
+	if compressed >= uncompressed {
+		t.Fatalf("Expected compressed backup (%d bytes) to be smaller than uncompressed "+
+			"backup (%d bytes)", compressed, uncompressed)
+	}
+}
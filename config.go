@@ -0,0 +1,186 @@
+package tests
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+)
+
+const (
+	clusterTypeClusterRun = "cluster_run"
+	clusterTypeServer     = "server"
+	clusterTypeMock       = "mock"
+)
+
+// testConfig describes the cluster the tests run against and where they keep
+// their archives. Values are resolved in the following order, with later
+// sources taking precedence: built in defaults, the config file, environment
+// variables and finally command line flags passed to `go test`.
+type testConfig struct {
+	Host          string `json:"host"`
+	Username      string `json:"username"`
+	Password      string `json:"password"`
+	DataPort      int    `json:"data_port"`
+	ArchiveDir    string `json:"archive_dir"`
+	ClusterType   string `json:"cluster_type"`
+	CbcompactPath string `json:"cbcompact_path"`
+	MaxBuckets    int    `json:"max_buckets"`
+	// Named storage config variants which the storage tests run under in
+	// addition to the default and the built-in variants, replacing any
+	// built-in variant of the same name. Each is a JSON object of overrides
+	// applied on top of storage.DefaultStorageConfig().
+	StorageConfigs map[string]json.RawMessage `json:"storage_configs"`
+}
+
+// testCfg is the configuration used by every test in the package. It is
+// populated by TestMain before any tests run.
+var testCfg = defaultTestConfig()
+
+type configOption struct {
+	flag  string
+	env   string
+	usage string
+	field func(c *testConfig) interface{}
+}
+
+var configOptions = []configOption{
+	{"host", "BACKUPTESTS_HOST", "cluster manager address",
+		func(c *testConfig) interface{} { return &c.Host }},
+	{"username", "BACKUPTESTS_USERNAME", "cluster administrator username",
+		func(c *testConfig) interface{} { return &c.Username }},
+	{"password", "BACKUPTESTS_PASSWORD", "cluster administrator password",
+		func(c *testConfig) interface{} { return &c.Password }},
+	{"data-port", "BACKUPTESTS_DATA_PORT", "data service port, defaults by cluster type",
+		func(c *testConfig) interface{} { return &c.DataPort }},
+	{"archive", "BACKUPTESTS_ARCHIVE", "root directory for test archives, defaults to a temp dir",
+		func(c *testConfig) interface{} { return &c.ArchiveDir }},
+	{"cluster-type", "BACKUPTESTS_CLUSTER_TYPE", "one of cluster_run, server or mock",
+		func(c *testConfig) interface{} { return &c.ClusterType }},
+	{"cbcompact", "BACKUPTESTS_CBCOMPACT", "path to the cbcompact binary",
+		func(c *testConfig) interface{} { return &c.CbcompactPath }},
+	{"max-buckets", "BACKUPTESTS_MAX_BUCKETS", "maximum number of buckets tests may create at once",
+		func(c *testConfig) interface{} { return &c.MaxBuckets }},
+	{"storage-configs", "BACKUPTESTS_STORAGE_CONFIGS", "named storage config overrides as JSON",
+		func(c *testConfig) interface{} { return &c.StorageConfigs }},
+}
+
+var configFile = flag.String("config", os.Getenv("BACKUPTESTS_CONFIG"),
+	"JSON file containing the test configuration")
+
+var configFlags = registerConfigFlags()
+
+func defaultTestConfig() *testConfig {
+	return &testConfig{
+		Host:          "http://127.0.0.1:9000",
+		Username:      "Administrator",
+		Password:      "password",
+		ClusterType:   clusterTypeClusterRun,
+		CbcompactPath: "cbcompact",
+		MaxBuckets:    10,
+	}
+}
+
+func registerConfigFlags() map[string]*string {
+	flags := make(map[string]*string)
+	for _, opt := range configOptions {
+		flags[opt.flag] = flag.String(opt.flag, "", opt.usage)
+	}
+	return flags
+}
+
+// loadTestConfig resolves the test configuration. It must be called after
+// flag.Parse().
+func loadTestConfig() (*testConfig, error) {
+	cfg := defaultTestConfig()
+
+	if *configFile != "" {
+		file, err := os.Open(*configFile)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+
+		if err := json.NewDecoder(file).Decode(cfg); err != nil {
+			return nil, fmt.Errorf("Unable to parse config file %s: %s", *configFile, err.Error())
+		}
+	}
+
+	for _, opt := range configOptions {
+		if value, ok := os.LookupEnv(opt.env); ok {
+			if err := setConfigField(opt.field(cfg), value); err != nil {
+				return nil, fmt.Errorf("Invalid value for %s: %s", opt.env, err.Error())
+			}
+		}
+	}
+
+	var err error
+	flag.Visit(func(f *flag.Flag) {
+		if value, ok := configFlags[f.Name]; ok && err == nil {
+			if e := setConfigField(configFieldByFlag(cfg, f.Name), *value); e != nil {
+				err = fmt.Errorf("Invalid value for -%s: %s", f.Name, e.Error())
+			}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	switch cfg.ClusterType {
+	case clusterTypeClusterRun, clusterTypeServer, clusterTypeMock:
+	default:
+		return nil, fmt.Errorf("Unknown cluster type `%s`", cfg.ClusterType)
+	}
+
+	for name, overrides := range cfg.StorageConfigs {
+		if _, err := storageConfigWith(overrides); err != nil {
+			return nil, fmt.Errorf("Invalid storage config `%s`: %s", name, err.Error())
+		}
+	}
+
+	if cfg.DataPort == 0 {
+		cfg.DataPort = 11210
+		if cfg.ClusterType == clusterTypeClusterRun {
+			cfg.DataPort = 12000
+		}
+	}
+
+	return cfg, nil
+}
+
+func configFieldByFlag(cfg *testConfig, name string) interface{} {
+	for _, opt := range configOptions {
+		if opt.flag == name {
+			return opt.field(cfg)
+		}
+	}
+	return nil
+}
+
+func setConfigField(field interface{}, value string) error {
+	switch f := field.(type) {
+	case *string:
+		*f = value
+	case *int:
+		v, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*f = v
+	case *map[string]json.RawMessage:
+		return json.Unmarshal([]byte(value), f)
+	}
+	return nil
+}
+
+// DataHost returns the host:port of the data service on the first node.
+func (c *testConfig) DataHost() string {
+	host := "127.0.0.1"
+	if u, err := url.Parse(c.Host); err == nil && u.Hostname() != "" {
+		host = u.Hostname()
+	}
+	return net.JoinHostPort(host, strconv.Itoa(c.DataPort))
+}
@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/couchbase/backup/storage"
+)
+
+func TestLoadTestConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "backuptests-config")
+	checkError(err, t)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "config.json")
+	data := `{"host": "http://10.0.0.1:8091", "username": "file-user", "archive_dir": "/tmp/file"}`
+	checkError(ioutil.WriteFile(path, []byte(data), 0644), t)
+
+	oldFile := *configFile
+	*configFile = path
+	defer func() { *configFile = oldFile }()
+
+	t.Setenv("BACKUPTESTS_USERNAME", "env-user")
+	t.Setenv("BACKUPTESTS_CLUSTER_TYPE", clusterTypeServer)
+
+	cfg, err := loadTestConfig()
+	checkError(err, t)
+
+	if cfg.Host != "http://10.0.0.1:8091" {
+		t.Fatalf("Expected host from config file, got %s", cfg.Host)
+	}
+
+	if cfg.Username != "env-user" {
+		t.Fatalf("Expected environment to override config file, got %s", cfg.Username)
+	}
+
+	if cfg.Password != "password" {
+		t.Fatalf("Expected default password, got %s", cfg.Password)
+	}
+
+	if cfg.DataPort != 11210 {
+		t.Fatalf("Expected server data port 11210, got %d", cfg.DataPort)
+	}
+
+	if cfg.DataHost() != "10.0.0.1:11210" {
+		t.Fatalf("Expected data host 10.0.0.1:11210, got %s", cfg.DataHost())
+	}
+
+	t.Setenv("BACKUPTESTS_STORAGE_CONFIGS", `{"typo": {"no_such_storage_setting": 1}}`)
+	if _, err := loadTestConfig(); err == nil {
+		t.Fatal("Expected storage config with an unknown setting to be rejected")
+	}
+	t.Setenv("BACKUPTESTS_STORAGE_CONFIGS", "{}")
+
+	t.Setenv("BACKUPTESTS_CLUSTER_TYPE", "bogus")
+	if _, err := loadTestConfig(); err == nil {
+		t.Fatal("Expected unknown cluster type to be rejected")
+	}
+}
+
+func TestBuiltinStorageConfigs(t *testing.T) {
+	builtin := builtinStorageConfigs()
+	if len(builtin) != len(builtinStorageVariants) {
+		t.Fatalf("Expected %d uniquely named built-in storage configs, got %d",
+			len(builtinStorageVariants), len(builtin))
+	}
+
+	for _, variant := range builtinStorageVariants {
+		if variant.reason == "" {
+			t.Fatalf("Built-in storage config %s has no reason to exist", variant.name)
+		} else if variant.name == defaultStorageVariant {
+			t.Fatalf("Built-in storage config %s replaces the default", variant.name)
+		}
+	}
+
+	for name, overrides := range builtin {
+		config, err := storageConfigWith(overrides)
+		if err != nil {
+			t.Fatalf("Built-in storage config %s is invalid: %s", name, err.Error())
+		}
+
+		if reflect.DeepEqual(config, storage.DefaultStorageConfig()) {
+			t.Fatalf("Built-in storage config %s does not differ from the default", name)
+		}
+	}
+
+	var replaced string
+	for name := range builtin {
+		replaced = name
+		break
+	}
+
+	oldConfigs := testCfg.StorageConfigs
+	testCfg.StorageConfigs = map[string]json.RawMessage{replaced: json.RawMessage(`{}`),
+		"extra": json.RawMessage(`{}`)}
+	defer func() { testCfg.StorageConfigs = oldConfigs }()
+
+	configs := storageConfigs()
+	if len(configs) != len(builtin)+1 {
+		t.Fatalf("Expected %d storage configs, got %d", len(builtin)+1, len(configs))
+	}
+
+	if string(configs[replaced]) != `{}` {
+		t.Fatalf("Expected test config to replace built-in storage config %s", replaced)
+	}
+
+	variants := storageVariants()
+	if variants[0] != defaultStorageVariant || len(variants) != len(configs)+1 {
+		t.Fatalf("Expected the default followed by every storage config, got %v", variants)
+	}
+}
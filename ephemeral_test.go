@@ -0,0 +1,91 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that ephemeral bucket data and settings are backed up and that the
+// backup can be restored into a recreated ephemeral bucket, an existing
+// ephemeral bucket and a couchbase bucket.
+func TestBackupEphemeralBucket(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "ephemeral")
+	bucket := env.bucket("ephemeral", t)
+	createEphemeralBucket(testCfg.Host, bucket, "", evictionNRU, t)
+
+	backupName := "ephemeral-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, "ephemeral",
+		false, t)
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	info, err := a.BackupInfo(backupName, name)
+	checkError(err, t)
+
+	if count := info[bucket].NumDocs; count != 2000 {
+		t.Fatalf("Expected to backup 2000 items, got %d", count)
+	}
+
+	// Restoring the bucket config should recreate the bucket as it was
+	deleteBucket(testCfg.Host, bucket, t, true)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForBucketHealthy(testCfg.Host, bucket, t)
+	settings := getBucketSettings(testCfg.Host, bucket, t)
+	if settings.BucketType != "ephemeral" || settings.EvictionPolicy != evictionNRU {
+		t.Fatalf("Expected restored bucket to be ephemeral with %s eviction, got %s with %s",
+			evictionNRU, settings.BucketType, settings.EvictionPolicy)
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+
+	// Restore into an existing ephemeral bucket
+	restoreConfig, err := newBackupConfig().
+		WithIncludeBuckets(bucket).
+		DisableBucketConfig().
+		Build()
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createEphemeralBucket(testCfg.Host, bucket, "", evictionNone, t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+
+	// Restore into a couchbase bucket
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+
+	if settings := getBucketSettings(testCfg.Host, bucket, t); settings.BucketType != "membase" {
+		t.Fatalf("Expected bucket to remain a couchbase bucket, got %s", settings.BucketType)
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
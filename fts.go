@@ -0,0 +1,274 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// ftsDefinition is an FTS index or alias definition as reported by the search
+// service. Definitions are kept as generic JSON so that settings the tests
+// don't know about are still compared.
+type ftsDefinition map[string]interface{}
+
+// The index definitions created by loadFTSIndexes. The custom index has its own
+// analyzer and type mappings, the default index uses the dynamic default
+// mapping and the alias targets both of them.
+const (
+	ftsCustomIndex = `{
+		"type": "fulltext-index",
+		"sourceType": "couchbase",
+		"sourceName": %q,
+		"params": {
+			"doc_config": {"mode": "type_field", "type_field": "type"},
+			"mapping": {
+				"analysis": {
+					"analyzers": {
+						"backup_analyzer": {
+							"type": "custom",
+							"tokenizer": "unicode",
+							"token_filters": ["to_lower", "stop_en"]
+						}
+					}
+				},
+				"default_analyzer": "standard",
+				"default_mapping": {"enabled": false, "dynamic": true},
+				"type_field": "type",
+				"types": {
+					"user": {
+						"enabled": true,
+						"dynamic": false,
+						"properties": {
+							"name": {
+								"enabled": true,
+								"dynamic": false,
+								"fields": [{
+									"name": "name",
+									"type": "text",
+									"analyzer": "backup_analyzer",
+									"index": true,
+									"store": true
+								}]
+							},
+							"age": {
+								"enabled": true,
+								"dynamic": false,
+								"fields": [{"name": "age", "type": "number", "index": true}]
+							}
+						}
+					}
+				}
+			},
+			"store": {"indexType": "scorch"}
+		},
+		"planParams": {"maxPartitionsPerPIndex": 171, "indexPartitions": 6}
+	}`
+
+	ftsDefaultIndex = `{
+		"type": "fulltext-index",
+		"sourceType": "couchbase",
+		"sourceName": %q,
+		"params": {
+			"mapping": {
+				"default_analyzer": "standard",
+				"default_mapping": {"enabled": true, "dynamic": true}
+			},
+			"store": {"indexType": "scorch"}
+		}
+	}`
+
+	ftsAlias = `{
+		"type": "fulltext-alias",
+		"sourceType": "nil",
+		"params": {"targets": {%q: {}, %q: {}}}
+	}`
+)
+
+// requireSearchService returns the address of the search service, skipping
+// the test if the cluster doesn't run one. The mock cluster runs a search
+// service which stores the definitions it is given.
+func requireSearchService(host string, t *testing.T) string {
+	searchURL := serviceURL(host, "fts", t)
+	if searchURL == "" {
+		t.Skip("Cluster has no search service")
+	}
+
+	return searchURL
+}
+
+// ftsIndexPrefix returns the prefix of the names of the FTS indexes created for
+// the bucket. FTS index names are global to the cluster, so they are derived
+// from the bucket name to keep parallel tests apart.
+func ftsIndexPrefix(bucket string) string {
+	return strings.ReplaceAll(bucket, ".", "_") + "_fts_"
+}
+
+// loadFTSIndexes creates a custom index, a default index and an alias over
+// both of them for the bucket and returns their names. The indexes are deleted
+// again when the test completes.
+func loadFTSIndexes(host, bucket string, t *testing.T) []string {
+	searchURL := requireSearchService(host, t)
+
+	prefix := ftsIndexPrefix(bucket)
+	custom, dflt, alias := prefix+"custom", prefix+"default", prefix+"alias"
+
+	t.Cleanup(func() { deleteFTSIndexes(host, prefix, t) })
+
+	putFTSIndex(searchURL, custom, fmt.Sprintf(ftsCustomIndex, bucket), t)
+	putFTSIndex(searchURL, dflt, fmt.Sprintf(ftsDefaultIndex, bucket), t)
+	putFTSIndex(searchURL, alias, fmt.Sprintf(ftsAlias, custom, dflt), t)
+
+	return []string{custom, dflt, alias}
+}
+
+func putFTSIndex(searchURL, name, definition string, t *testing.T) {
+	req, err := http.NewRequest("PUT", searchURL+"/api/index/"+name,
+		bytes.NewReader([]byte(definition)))
+	checkError(err, t)
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		var body map[string]interface{}
+		json.NewDecoder(resp.Body).Decode(&body)
+		t.Fatalf("Creating FTS index %s failed with status %d: %v", name, resp.StatusCode,
+			body)
+	}
+}
+
+// deleteFTSIndexes deletes every FTS index and alias whose name starts with the
+// prefix.
+func deleteFTSIndexes(host, prefix string, t *testing.T) {
+	searchURL := serviceURL(host, "fts", t)
+	if searchURL == "" {
+		return
+	}
+
+	for name := range ftsDefinitions(host, prefix, t) {
+		req, err := http.NewRequest("DELETE", searchURL+"/api/index/"+name, nil)
+		checkError(err, t)
+		req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+		resp, err := http.DefaultClient.Do(req)
+		checkError(err, t)
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("Deleting FTS index %s returned %d", name, resp.StatusCode)
+		}
+	}
+}
+
+// ftsDefinitions returns the definitions of every FTS index and alias whose
+// name starts with the prefix keyed by name. The UUIDs of the index and its
+// source bucket change whenever either is recreated, so they are removed.
+func ftsDefinitions(host, prefix string, t *testing.T) map[string]ftsDefinition {
+	searchURL := requireSearchService(host, t)
+
+	req, err := http.NewRequest("GET", searchURL+"/api/index", nil)
+	checkError(err, t)
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Getting FTS indexes returned %d", resp.StatusCode)
+	}
+
+	type overlay struct {
+		IndexDefs struct {
+			IndexDefs map[string]ftsDefinition `json:"indexDefs"`
+		} `json:"indexDefs"`
+	}
+
+	var data overlay
+	checkError(json.NewDecoder(resp.Body).Decode(&data), t)
+
+	definitions := make(map[string]ftsDefinition)
+	for name, definition := range data.IndexDefs.IndexDefs {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+
+		delete(definition, "uuid")
+		delete(definition, "sourceUUID")
+		definitions[name] = definition
+	}
+
+	return definitions
+}
+
+// verifyFTSDefinitions fails the test if the FTS definitions whose names start
+// with the prefix differ from the expected definitions. Indexes restored with a
+// bucket map are expected to have their source bucket rewritten to the mapped
+// bucket.
+func verifyFTSDefinitions(host, prefix string, expected map[string]ftsDefinition,
+	bucketMap map[string]string, t *testing.T) {
+	t.Helper()
+
+	actual := ftsDefinitions(host, prefix, t)
+
+	diffs := make([]string, 0)
+	for name, definition := range expected {
+		want := make(ftsDefinition, len(definition))
+		for key, value := range definition {
+			want[key] = value
+		}
+
+		if source, ok := want["sourceName"].(string); ok && bucketMap[source] != "" {
+			want["sourceName"] = bucketMap[source]
+		}
+
+		got, ok := actual[name]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("FTS index %s is missing", name))
+			continue
+		}
+
+		for _, key := range definitionKeys(want, got) {
+			if !reflect.DeepEqual(want[key], got[key]) {
+				diffs = append(diffs, fmt.Sprintf("FTS index %s %s expected %v, got %v", name,
+					key, want[key], got[key]))
+			}
+		}
+	}
+
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected FTS index %s", name))
+		}
+	}
+
+	if len(diffs) > 0 {
+		sort.Strings(diffs)
+		t.Fatalf("FTS definitions do not match: %s", strings.Join(diffs, ", "))
+	}
+}
+
+// definitionKeys returns the sorted union of the top level keys of both
+// definitions.
+func definitionKeys(a, b ftsDefinition) []string {
+	keys := make([]string, 0, len(a)+len(b))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range b {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	return keys
+}
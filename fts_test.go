@@ -0,0 +1,110 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that FTS index and alias definitions are backed up and recreated by
+// the restore.
+func TestBackupRestoreFTSIndexes(t *testing.T) {
+	t.Parallel()
+	requireSearchService(testCfg.Host, t)
+
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "fts-test"
+	prefix := ftsIndexPrefix(bucket)
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "fts", false, t)
+	names := loadFTSIndexes(testCfg.Host, bucket, t)
+	expected := ftsDefinitions(testCfg.Host, prefix, t)
+	for _, name := range names {
+		if _, ok := expected[name]; !ok {
+			t.Fatalf("Expected FTS index %s to be created, got %d indexes", name, len(expected))
+		}
+	}
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// Restoring without FTS should not recreate any of the indexes
+	restoreConfig, err := newBackupConfig().WithIncludeBuckets(bucket).DisableFTS().Build()
+	checkError(err, t)
+
+	deleteFTSIndexes(testCfg.Host, prefix, t)
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
+	verifyFTSDefinitions(testCfg.Host, prefix, map[string]ftsDefinition{}, nil, t)
+
+	// A full restore should recreate every index and alias as it was defined
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	verifyFTSDefinitions(testCfg.Host, prefix, expected, nil, t)
+}
+
+// Tests that FTS indexes restored into a bucket with a different name are
+// pointed at the new bucket.
+func TestRestoreFTSIndexesBucketMap(t *testing.T) {
+	t.Parallel()
+	requireSearchService(testCfg.Host, t)
+
+	env := newTestEnv(t, "default", "mapped")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("mapped", t), "", t)
+
+	backupName := "fts-bucket-map-test"
+	prefix := ftsIndexPrefix(env.bucket("default", t))
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("default", t), 1000,
+		"fts", false, t)
+	loadFTSIndexes(testCfg.Host, env.bucket("default", t), t)
+	expected := ftsDefinitions(testCfg.Host, prefix, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucket("default", t)).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// Index names are global, so the originals have to go before the restore
+	deleteFTSIndexes(testCfg.Host, prefix, t)
+
+	bucketMap := map[string]string{env.bucket("default", t): env.bucket("mapped", t)}
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, restoreOptions{BucketMap: bucketMap}, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("mapped", t),
+		1000, t)
+	verifyFTSDefinitions(testCfg.Host, prefix, expected, bucketMap, t)
+}
@@ -0,0 +1,174 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// gsiIndex is a GSI index created by loadGSIIndexes.
+type gsiIndex struct {
+	Name      string
+	Statement string
+	Deferred  bool
+}
+
+// queryServiceURL returns the address of the query service on the cluster, or
+// an empty string if no node runs the query service.
+func queryServiceURL(host string, t *testing.T) string {
+	address := serviceURL(host, "n1ql", t)
+	if address == "" {
+		return ""
+	}
+
+	return address + "/query/service"
+}
+
+// requireQueryService returns the address of the query service, skipping the
+// test if the cluster doesn't run one. The mock cluster runs a query service
+// which understands the statements loadGSIIndexes sends.
+func requireQueryService(host string, t *testing.T) string {
+	queryURL := queryServiceURL(host, t)
+	if queryURL == "" {
+		t.Skip("Cluster has no query service")
+	}
+
+	return queryURL
+}
+
+// executeQuery runs a N1QL statement and fails the test if it doesn't succeed.
+func executeQuery(queryURL, statement string, t *testing.T) {
+	form := url.Values{}
+	form.Set("statement", statement)
+
+	req, err := http.NewRequest("POST", queryURL, strings.NewReader(form.Encode()))
+	checkError(err, t)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	var result struct {
+		Status string            `json:"status"`
+		Errors []json.RawMessage `json:"errors"`
+	}
+	checkError(json.NewDecoder(resp.Body).Decode(&result), t)
+
+	if resp.StatusCode != http.StatusOK || result.Status != "success" {
+		errs := make([]string, 0, len(result.Errors))
+		for _, e := range result.Errors {
+			errs = append(errs, string(e))
+		}
+		t.Fatalf("Query `%s` failed with status %d: %s", statement, resp.StatusCode,
+			strings.Join(errs, ", "))
+	}
+}
+
+// loadGSIIndexes creates one of each kind of GSI index on the bucket and
+// returns them. The deferred index is never built, so it is not expected to
+// come online.
+func loadGSIIndexes(host, bucket string, t *testing.T) []gsiIndex {
+	queryURL := requireQueryService(host, t)
+
+	keyspace := "`" + bucket + "`"
+	indexes := []gsiIndex{
+		{Name: "#primary", Statement: "CREATE PRIMARY INDEX ON " + keyspace},
+		{Name: "idx_name", Statement: "CREATE INDEX idx_name ON " + keyspace + "(name)"},
+		{
+			Name:      "idx_composite",
+			Statement: "CREATE INDEX idx_composite ON " + keyspace + "(type, name, age)",
+		},
+		{
+			Name: "idx_partial",
+			Statement: "CREATE INDEX idx_partial ON " + keyspace +
+				"(name) WHERE type = \"user\" AND age > 21",
+		},
+		{
+			Name: "idx_array",
+			Statement: "CREATE INDEX idx_array ON " + keyspace +
+				"(DISTINCT ARRAY tag FOR tag IN tags END)",
+		},
+		{
+			Name: "idx_deferred",
+			Statement: "CREATE INDEX idx_deferred ON " + keyspace +
+				"(email) WITH {\"defer_build\":true}",
+			Deferred: true,
+		},
+		{
+			Name: "idx_partitioned",
+			Statement: "CREATE INDEX idx_partitioned ON " + keyspace +
+				"(age) PARTITION BY HASH(META().id)",
+		},
+	}
+
+	for _, index := range indexes {
+		executeQuery(queryURL, index.Statement, t)
+	}
+
+	return indexes
+}
+
+// waitForGSIIndexes waits until every index is present and every index that
+// isn't deferred is online.
+func waitForGSIIndexes(host, bucket string, indexes []gsiIndex, t *testing.T) {
+	t.Helper()
+
+	online := 0
+	for _, index := range indexes {
+		if !index.Deferred {
+			online++
+		}
+	}
+
+	waitForIndexes(host, bucket, len(indexes), online, t)
+}
+
+// indexDefinitions returns the definition of every GSI index on the bucket
+// keyed by index name.
+func indexDefinitions(host, bucket string, t *testing.T) map[string]string {
+	indexes, err := getIndexes(host, bucket)
+	checkError(err, t)
+
+	definitions := make(map[string]string)
+	for _, index := range indexes {
+		definitions[index.Index] = index.Definition
+	}
+
+	return definitions
+}
+
+// verifyIndexDefinitions fails the test if the GSI index definitions on the
+// bucket differ from the expected definitions.
+func verifyIndexDefinitions(host, bucket string, expected map[string]string, t *testing.T) {
+	t.Helper()
+
+	actual := indexDefinitions(host, bucket, t)
+
+	diffs := make([]string, 0)
+	for name, definition := range expected {
+		if got, ok := actual[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("index %s is missing", name))
+		} else if got != definition {
+			diffs = append(diffs, fmt.Sprintf("index %s expected `%s`, got `%s`", name,
+				definition, got))
+		}
+	}
+
+	for name := range actual {
+		if _, ok := expected[name]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected index %s", name))
+		}
+	}
+
+	if len(diffs) > 0 {
+		sort.Strings(diffs)
+		t.Fatalf("Index definitions of bucket %s do not match: %s", bucket,
+			strings.Join(diffs, ", "))
+	}
+}
@@ -0,0 +1,62 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that GSI index definitions, including deferred and partitioned
+// indexes, are backed up and recreated by the restore.
+func TestBackupRestoreGSIIndexes(t *testing.T) {
+	t.Parallel()
+	requireQueryService(testCfg.Host, t)
+
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "gsi-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "gsi", false, t)
+	indexes := loadGSIIndexes(testCfg.Host, bucket, t)
+	waitForGSIIndexes(testCfg.Host, bucket, indexes, t)
+	expected := indexDefinitions(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// Restoring without GSI should leave the bucket without indexes
+	restoreConfig, err := newBackupConfig().WithIncludeBuckets(bucket).DisableGSI().Build()
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
+	verifyIndexDefinitions(testCfg.Host, bucket, map[string]string{}, t)
+
+	// A full restore should recreate every index as it was defined
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForGSIIndexes(testCfg.Host, bucket, indexes, t)
+	verifyIndexDefinitions(testCfg.Host, bucket, expected, t)
+}
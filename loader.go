@@ -0,0 +1,246 @@
+package tests
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/couchbase/gocb"
+)
+
+type loadMode int
+
+const (
+	loadInsert loadMode = iota
+	loadUpsert
+	loadReplace
+	loadRemove
+)
+
+func (m loadMode) String() string {
+	switch m {
+	case loadInsert:
+		return "insert"
+	case loadUpsert:
+		return "upsert"
+	case loadReplace:
+		return "replace"
+	case loadRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+const (
+	defaultLoadWorkers   = 8
+	defaultLoadBatchSize = 256
+)
+
+// loadOptions controls how bulkLoad writes documents. Zero values use the
+// defaults.
+type loadOptions struct {
+	Mode      loadMode
+	Workers   int
+	BatchSize int
+	// Pads each document with a highly compressible filler so that it is at
+	// least this many bytes
+	DocSize int
+	// Returns the expiry of document i, either a TTL in seconds or an absolute
+	// unix time as understood by the data service. Documents never expire if
+	// this is nil
+	Expiry func(i int) uint32
+}
+
+// TTLs longer than this are taken by the data service to be absolute unix
+// times, so longer TTLs have to be sent as the time they expire.
+const maxRelativeTTL = 30 * 24 * time.Hour
+
+// ttlExpiry returns the expiry to send for a document that should live for ttl
+// from now.
+func ttlExpiry(ttl time.Duration) uint32 {
+	if ttl > maxRelativeTTL {
+		return uint32(time.Now().Add(ttl).Unix())
+	}
+	return uint32(ttl.Seconds())
+}
+
+// fixedTTL gives every document the same TTL.
+func fixedTTL(ttl time.Duration) func(int) uint32 {
+	return func(int) uint32 {
+		return ttlExpiry(ttl)
+	}
+}
+
+// rangedTTL spreads the TTLs of the documents over [min, max) one second
+// apart, so that consecutive documents expire at different times. Ranges
+// shorter than a second give every document the minimum TTL.
+func rangedTTL(min, max time.Duration) func(int) uint32 {
+	span := int((max - min).Seconds())
+	return func(i int) uint32 {
+		if span <= 0 {
+			return ttlExpiry(min)
+		}
+		return ttlExpiry(min + time.Duration(i%span)*time.Second)
+	}
+}
+
+// expiresAt gives every document the same absolute expiry time.
+func expiresAt(when time.Time) func(int) uint32 {
+	return func(int) uint32 {
+		return uint32(when.Unix())
+	}
+}
+
+// loadStats describes a completed bulk load.
+type loadStats struct {
+	Items    int
+	Duration time.Duration
+}
+
+func (s loadStats) Throughput() float64 {
+	if s.Duration <= 0 {
+		return 0
+	}
+	return float64(s.Items) / s.Duration.Seconds()
+}
+
+// bulkLoad applies the load mode to the keys prefix0 to prefix<items-1>. Keys
+// are split into batches which are shared out between a pool of workers, each
+// of which sends its batches as gocb bulk operations.
+func bulkLoad(host, username, password, bucket string, items int, prefix string,
+	opts loadOptions, t *testing.T) loadStats {
+	if opts.Workers <= 0 {
+		opts.Workers = defaultLoadWorkers
+	}
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = defaultLoadBatchSize
+	}
+
+	connection, err := gocb.Connect(host)
+	if err != nil {
+		t.Fatal("Test data loader cannot connect to the cluster: " + err.Error())
+	}
+
+	connection.Authenticate(gocb.PasswordAuthenticator{
+		Username: username,
+		Password: password,
+	})
+
+	b, err := connection.OpenBucket(bucket, "")
+	if err != nil {
+		t.Fatal("Test data loader cannot connect to the bucket: " + err.Error())
+	}
+	defer b.Close()
+
+	batches := make(chan int)
+	errs := make(chan error, opts.Workers)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+
+	for w := 0; w < opts.Workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for first := range batches {
+				last := first + opts.BatchSize
+				if last > items {
+					last = items
+				}
+
+				if err := loadBatch(b, prefix, first, last, opts); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+
+	var loadErr error
+	for first := 0; first < items && loadErr == nil; first += opts.BatchSize {
+		select {
+		case batches <- first:
+		case loadErr = <-errs:
+		}
+	}
+	close(batches)
+	wg.Wait()
+
+	if loadErr == nil {
+		select {
+		case loadErr = <-errs:
+		default:
+		}
+	}
+
+	if loadErr != nil {
+		t.Fatal(loadErr.Error())
+	}
+
+	stats := loadStats{Items: items, Duration: time.Since(start)}
+	t.Logf("Loader %s %d items in %s with prefix `%s` in %s (%.0f items/sec)", opts.Mode,
+		items, bucket, prefix, stats.Duration, stats.Throughput())
+
+	return stats
+}
+
+func loadBatch(b *gocb.Bucket, prefix string, first, last int, opts loadOptions) error {
+	mode := opts.Mode
+	filler := ""
+	if opts.DocSize > 0 {
+		filler = strings.Repeat("a", opts.DocSize)
+	}
+
+	ops := make([]gocb.BulkOp, 0, last-first)
+	for i := first; i < last; i++ {
+		key := prefix + strconv.Itoa(i)
+		doc := map[string]interface{}{"x": i}
+		if filler != "" {
+			doc["filler"] = filler
+		}
+
+		expiry := uint32(0)
+		if opts.Expiry != nil {
+			expiry = opts.Expiry(i)
+		}
+
+		switch mode {
+		case loadInsert:
+			ops = append(ops, &gocb.InsertOp{Key: key, Value: doc, Expiry: expiry})
+		case loadUpsert:
+			ops = append(ops, &gocb.UpsertOp{Key: key, Value: doc, Expiry: expiry})
+		case loadReplace:
+			ops = append(ops, &gocb.ReplaceOp{Key: key, Value: doc, Expiry: expiry})
+		case loadRemove:
+			ops = append(ops, &gocb.RemoveOp{Key: key})
+		}
+	}
+
+	if err := b.Do(ops); err != nil {
+		return fmt.Errorf("Error sending %s batch: %s", mode, err.Error())
+	}
+
+	for i, op := range ops {
+		var err error
+		switch o := op.(type) {
+		case *gocb.InsertOp:
+			err = o.Err
+		case *gocb.UpsertOp:
+			err = o.Err
+		case *gocb.ReplaceOp:
+			err = o.Err
+		case *gocb.RemoveOp:
+			err = o.Err
+		}
+
+		if err != nil {
+			return fmt.Errorf("Error running %s on `%s%d`, %s", mode, prefix, first+i,
+				err.Error())
+		}
+	}
+
+	return nil
+}
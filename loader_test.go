@@ -0,0 +1,80 @@
+package tests
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestBulkLoadModes(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	opts := loadOptions{Mode: loadInsert, Workers: 4, BatchSize: 100}
+	stats := bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2050,
+		"bulk", opts, t)
+	if stats.Items != 2050 {
+		t.Fatalf("Expected loader to report 2050 items, got %d", stats.Items)
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2050, t)
+
+	opts.Mode = loadUpsert
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 3000, "bulk", opts, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 3000, t)
+
+	opts.Mode = loadReplace
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 3000, "bulk", opts, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 3000, t)
+
+	opts.Mode = loadRemove
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "bulk", opts, t)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+}
+
+func TestBulkLoadExpiry(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	absolute := time.Now().Add(2 * time.Hour).Truncate(time.Second)
+
+	start := time.Now()
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 100, "fixed",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(time.Hour)}, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 100, "ranged",
+		loadOptions{Mode: loadInsert, Expiry: rangedTTL(time.Hour, time.Hour+50*time.Second)},
+		t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 100, "absolute",
+		loadOptions{Mode: loadInsert, Expiry: expiresAt(absolute)}, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 100, "long",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(60 * 24 * time.Hour)}, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 100, "forever",
+		loadOptions{Mode: loadInsert}, t)
+	done := time.Now()
+
+	// Long TTLs must not be mistaken for absolute times in the past
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, t)
+
+	docs := takeSnapshot(testCfg.Host, bucket, t)
+	for i := 0; i < 100; i++ {
+		requireExpiryWithin(docs["fixed"+strconv.Itoa(i)], start.Add(time.Hour),
+			done.Add(time.Hour), t)
+
+		// Ranged TTLs repeat every 50 documents
+		offset := time.Hour + time.Duration(i%50)*time.Second
+		requireExpiryWithin(docs["ranged"+strconv.Itoa(i)], start.Add(offset), done.Add(offset),
+			t)
+
+		requireExpiryWithin(docs["absolute"+strconv.Itoa(i)], absolute, absolute, t)
+		requireExpiryWithin(docs["long"+strconv.Itoa(i)], start.Add(60*24*time.Hour),
+			done.Add(60*24*time.Hour), t)
+
+		if doc := docs["forever"+strconv.Itoa(i)]; doc.Expiry != 0 {
+			t.Fatalf("Expected %s to never expire, got expiry %d", doc.Key, doc.Expiry)
+		}
+	}
+}
@@ -0,0 +1,31 @@
+package tests
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+
+	cfg, err := loadTestConfig()
+	if err != nil {
+		fmt.Println(err.Error())
+		os.Exit(2)
+	}
+	testCfg = cfg
+
+	if cfg.ClusterType == clusterTypeMock {
+		mc := newMockCluster(cfg.Username, cfg.Password)
+		cfg.Host = mc.URL()
+		cfg.DataPort = mc.kv.port()
+
+		code := m.Run()
+		mc.Close()
+		os.Exit(code)
+	}
+
+	os.Exit(m.Run())
+}
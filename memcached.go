@@ -0,0 +1,115 @@
+package tests
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+const (
+	mcReqMagic = 0x80
+	mcResMagic = 0x81
+
+	mcHeaderLen = 24
+)
+
+const (
+	mcGet            = 0x00
+	mcSet            = 0x01
+	mcAdd            = 0x02
+	mcReplace        = 0x03
+	mcDelete         = 0x04
+	mcNoop           = 0x0a
+	mcHello          = 0x1f
+	mcSaslListMechs  = 0x20
+	mcSaslAuth       = 0x21
+	mcGetAllVBSeqnos = 0x48
+	mcDcpOpen        = 0x50
+	mcDcpCloseStream = 0x52
+	mcDcpStreamReq   = 0x53
+	mcDcpFailoverLog = 0x54
+	mcDcpStreamEnd   = 0x55
+	mcDcpSnapshot    = 0x56
+	mcDcpMutation    = 0x57
+	mcDcpDeletion    = 0x58
+	mcDcpExpiration  = 0x59
+	mcDcpNoop        = 0x5c
+	mcDcpBufferAck   = 0x5d
+	mcDcpControl     = 0x5e
+	mcSelectBucket   = 0x89
+	mcSetWithMeta    = 0xa2
+	mcDelWithMeta    = 0xa8
+	mcGetClusterConf = 0xb5
+	mcGetErrorMap    = 0xfe
+)
+
+const (
+	mcStatusSuccess     = 0x00
+	mcStatusKeyNotFound = 0x01
+	mcStatusKeyExists   = 0x02
+	mcStatusInvalid     = 0x04
+	mcStatusNoBucket    = 0x08
+	mcStatusAuthError   = 0x20
+	mcStatusRollback    = 0x23
+	mcStatusAccess      = 0x24
+	mcStatusUnknownCmd  = 0x81
+)
+
+// Force flag accepted in the options of the *_WITH_META commands.
+const mcSkipConflictResolution = 0x01
+
+// mcPacket is a memcached binary protocol request or response.
+type mcPacket struct {
+	magic    uint8
+	opcode   uint8
+	datatype uint8
+	vbucket  uint16 // holds the status on responses
+	opaque   uint32
+	cas      uint64
+	extras   []byte
+	key      []byte
+	value    []byte
+}
+
+func readPacket(r io.Reader) (*mcPacket, error) {
+	hdr := make([]byte, mcHeaderLen)
+	if _, err := io.ReadFull(r, hdr); err != nil {
+		return nil, err
+	}
+
+	keyLen := int(binary.BigEndian.Uint16(hdr[2:4]))
+	extLen := int(hdr[4])
+	bodyLen := int(binary.BigEndian.Uint32(hdr[8:12]))
+
+	body := make([]byte, bodyLen)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+
+	return &mcPacket{
+		magic:    hdr[0],
+		opcode:   hdr[1],
+		datatype: hdr[5],
+		vbucket:  binary.BigEndian.Uint16(hdr[6:8]),
+		opaque:   binary.BigEndian.Uint32(hdr[12:16]),
+		cas:      binary.BigEndian.Uint64(hdr[16:24]),
+		extras:   body[:extLen],
+		key:      body[extLen : extLen+keyLen],
+		value:    body[extLen+keyLen:],
+	}, nil
+}
+
+func (p *mcPacket) bytes() []byte {
+	buf := make([]byte, mcHeaderLen, mcHeaderLen+len(p.extras)+len(p.key)+len(p.value))
+	buf[0] = p.magic
+	buf[1] = p.opcode
+	binary.BigEndian.PutUint16(buf[2:4], uint16(len(p.key)))
+	buf[4] = uint8(len(p.extras))
+	buf[5] = p.datatype
+	binary.BigEndian.PutUint16(buf[6:8], p.vbucket)
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(p.extras)+len(p.key)+len(p.value)))
+	binary.BigEndian.PutUint32(buf[12:16], p.opaque)
+	binary.BigEndian.PutUint64(buf[16:24], p.cas)
+	buf = append(buf, p.extras...)
+	buf = append(buf, p.key...)
+	return append(buf, p.value...)
+}
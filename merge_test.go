@@ -4,182 +4,208 @@ import (
 	"os/exec"
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/couchbase/backup/archive"
 	"github.com/couchbase/backup/storage"
-	"github.com/couchbase/backup/value"
 )
 
 func TestMerge(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	model := newShadowModel()
 
 	setName := "incr-backup-test"
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(setName, config), t)
 
 	// Do full backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
 
-	name1, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name1, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name1)
 
 	info, err := a.BackupInfo(setName, name1)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
-		t.Fatal("Expected to backup 5000 items, got %d", count)
+		t.Fatalf("Expected to backup 5000 items, got %d", count)
 	}
 
 	// Do first incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 4000, "incr-1-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 4000, "incr-1-", false, t)
 
-	name2, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name2, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name2)
 
 	info, err = a.BackupInfo(setName, name2)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 4000 {
-		t.Fatal("Expected to backup 4000 items, got %d", count)
+		t.Fatalf("Expected to backup 4000 items, got %d", count)
 	}
 
 	// Do second incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 3000, "incr-2-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 3000, "incr-2-", false, t)
 
-	name3, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name3, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name3)
 
 	info, err = a.BackupInfo(setName, name3)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 3000 {
-		t.Fatal("Expected to backup 3000 items, got %d", count)
+		t.Fatalf("Expected to backup 3000 items, got %d", count)
 	}
 
 	// Do third incremental backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 2000, "incr-3-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 2000, "incr-3-", false, t)
 
-	name4, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name4, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name4)
 
 	info, err = a.BackupInfo(setName, name4)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
+	count = info[env.bucket("default", t)].NumDocs
 	if count != 2000 {
-		t.Fatal("Expected to backup 2000 items, got %d", count)
+		t.Fatalf("Expected to backup 2000 items, got %d", count)
 	}
 
 	// Merge the backups and make sure all the items show up in the merged backup
 	_, err = a.MergeIncrBackups(setName, name1, name4, storage.DefaultStorageConfig())
 	checkError(err, t)
+	model.merge(name1, name4, t)
 
 	info, err = a.BackupInfo(setName, name4)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
-	if count != 14000 {
-		t.Fatalf("Expected to backup 14000 items, got %d", count)
+	count = info[env.bucket("default", t)].NumDocs
+	if expected := model.backupDocs(env.bucket("default", t), name4, t); count != expected {
+		t.Fatalf("Expected to backup %d items, got %d", expected, count)
 	}
+	model.verifyBackup(a, setName, name4, env.bucket("default", t), t)
 
 	binfo, err := a.RepoInfo(setName)
+	checkError(err, t)
+
 	if binfo.NumBackups != 1 {
-		t.Fatalf("Expected 1 incr backups after merge, got %d", count)
+		t.Fatalf("Expected 1 incr backups after merge, got %d", binfo.NumBackups)
 	}
 }
 
 func TestMergeAfterPurge(t *testing.T) {
-	//defer cleanup()
-	//defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	cbcompact := requireCbcompact(t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	model := newShadowModel()
 
 	setName := "incr-backup-test"
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(setName, config), t)
 
 	// Do full backup
-	loadData(testHost, rbacUsername, rbacPassword, "default", 10000, "full", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 10000, "full", false, t)
 
-	name1, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name1, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name1)
 
 	info, err := a.BackupInfo(setName, name1)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 10000 {
-		t.Fatal("Expected to backup 10000 items, got %d", count)
+		t.Fatalf("Expected to backup 10000 items, got %d", count)
 	}
 
 	// Do incremental backup after purge
-	loadData(testHost, rbacUsername, rbacPassword, "default", 15000, "incr-1-", false, t)
-	loadData(testHost, rbacUsername, rbacPassword, "default", 10000, "incr-1-", true, t)
-	loadData(testHost, rbacUsername, rbacPassword, "default", 10000, "incr-1-extra-", false, t)
-
-	cmd := "/Users/mikewied/couchbase/spock/kv_engine/engines/ep/management/cbcompact"
-
-	for vbid := 0; vbid < 1024; vbid++ {
-		args := []string{"127.0.0.1:12000", "compact", strconv.Itoa(vbid), "-b", "default",
-			"-u", "Administrator", "-p", "password", "--purge-only-upto-seq", "100000",
-			"--dropdeletes"}
-		if err := exec.Command(cmd, args...).Run(); err != nil {
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 15000, "incr-1-", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 10000, "incr-1-", true, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 10000, "incr-1-extra-", false, t)
+
+	numVBuckets := bucketNumVBuckets(testCfg.Host, env.bucket("default", t), t)
+	for vbid := 0; vbid < numVBuckets; vbid++ {
+		args := []string{testCfg.DataHost(), "compact", strconv.Itoa(vbid),
+			"-b", env.bucket("default", t), "-u", testCfg.Username, "-p", testCfg.Password,
+			"--purge-only-upto-seq", "100000", "--dropdeletes"}
+		if err := exec.Command(cbcompact, args...).Run(); err != nil {
 			t.Fatal(err.Error())
 		}
 	}
+	model.purgeTombstones(env.bucket("default", t))
 
-	time.Sleep(5 * time.Second)
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 25000, t)
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "incr-1-final", false, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "incr-1-final", false, t)
 
-	name2, err := executeBackup(a, setName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name2, err := executeBackup(a, setName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name2)
 
 	info, err = a.BackupInfo(setName, name2)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
-	if count != 30000 {
-		t.Fatalf("Expected to backup 30000 items, got %d", count)
+	count = info[env.bucket("default", t)].NumDocs
+	if expected := model.backupDocs(env.bucket("default", t), name2, t); count != expected {
+		t.Fatalf("Expected to backup %d items, got %d", expected, count)
 	}
+	model.verifyBackup(a, setName, name2, env.bucket("default", t), t)
 
 	// Merge the backups and make sure all the items show up in the merged backup
 	_, err = a.MergeIncrBackups(setName, name1, name2, storage.DefaultStorageConfig())
 	checkError(err, t)
+	model.merge(name1, name2, t)
 
 	info, err = a.BackupInfo(setName, name2)
 	checkError(err, t)
 
-	count = info["default"].NumDocs
-	if count != 30000 {
-		t.Fatalf("Expected to backup 30000 items, got %d", count)
+	count = info[env.bucket("default", t)].NumDocs
+	if expected := model.backupDocs(env.bucket("default", t), name2, t); count != expected {
+		t.Fatalf("Expected to backup %d items, got %d", expected, count)
 	}
+	model.verifyBackup(a, setName, name2, env.bucket("default", t), t)
 
 	binfo, err := a.RepoInfo(setName)
+	checkError(err, t)
+
 	if binfo.NumBackups != 1 {
-		t.Fatalf("Expected 1 incr backups after merge, got %d", count)
+		t.Fatalf("Expected 1 incr backups after merge, got %d", binfo.NumBackups)
 	}
 }
@@ -0,0 +1,780 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The number of vbuckets in every couchbase bucket on the mock cluster.
+const mockNumVBuckets = 1024
+
+// mockBucket holds everything the mock cluster manager knows about a bucket.
+type mockBucket struct {
+	name          string
+	uuid          string
+	bucketType    string
+	eviction      string
+	password      string
+	quota         int
+	replicas      int
+	flushEnabled  bool
+	indexReplicas bool
+	// Applied to the expiry of every document written to the bucket
+	maxTTL int
+	// Settings that are stored and reported back but otherwise ignored
+	conflictResolution string
+	compressionMode    string
+	durabilityMinLevel string
+	ddocs              map[string]json.RawMessage
+	ddocRevs           map[string]int
+	indexes            map[string]mockIndex
+	store              *mockStore
+}
+
+// mockUser is a local RBAC user. Roles are in the form role[bucket], where a
+// bucket of * grants the role on every bucket.
+type mockUser struct {
+	password string
+	roles    []string
+}
+
+// mockCluster is an in-process stand-in for the cluster manager REST API. It
+// implements enough of the /pools and views endpoints for the test harness
+// and the backup library to run without a real cluster. Bucket data is served
+// by an accompanying mockMemcached.
+type mockCluster struct {
+	server   *httptest.Server
+	kv       *mockMemcached
+	username string
+	password string
+
+	mutex   sync.Mutex
+	buckets map[string]*mockBucket
+	users   map[string]*mockUser
+	rev     int
+	nextId  int
+	// FTS indexes and aliases keyed by name, which is global to the cluster
+	ftsIndexes map[string]mockFTSIndex
+
+	faults mockFaults
+}
+
+func newMockCluster(username, password string) *mockCluster {
+	mc := &mockCluster{
+		username:   username,
+		password:   password,
+		buckets:    make(map[string]*mockBucket),
+		users:      make(map[string]*mockUser),
+		rev:        1,
+		ftsIndexes: make(map[string]mockFTSIndex),
+		faults:     mockFaults{dropVBucket: -1},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/pools", mc.handlePools)
+	mux.HandleFunc("/pools/default", mc.handlePoolsDefault)
+	mux.HandleFunc("/pools/default/nodeServices", mc.handleNodeServices)
+	mux.HandleFunc("/pools/default/buckets", mc.handleBuckets)
+	mux.HandleFunc("/pools/default/buckets/", mc.handleBucket)
+	mux.HandleFunc("/pools/default/b/", mc.handleTerseBucket)
+	mux.HandleFunc("/pools/default/bs/", mc.handleStreamingBucket)
+	mux.HandleFunc("/pools/default/bucketsStreaming/", mc.handleStreamingBucket)
+	mux.HandleFunc("/couchBase/", mc.handleCouchBase)
+	mux.HandleFunc("/indexStatus", mc.handleIndexStatus)
+	mux.HandleFunc("/query/service", mc.handleQuery)
+	mux.HandleFunc("/getIndexMetadata", mc.handleGetIndexMetadata)
+	mux.HandleFunc("/restoreIndexMetadata", mc.handleRestoreIndexMetadata)
+	mux.HandleFunc("/api/index", mc.handleFTSIndexes)
+	mux.HandleFunc("/api/index/", mc.handleFTSIndex)
+	mux.HandleFunc("/settings/rbac/users/local/", mc.handleUser)
+
+	mc.server = httptest.NewServer(mc.injectFaults(mux))
+
+	kv, err := newMockMemcached(mc)
+	if err != nil {
+		mc.server.Close()
+		panic("mock cluster failed to start data service: " + err.Error())
+	}
+	mc.kv = kv
+
+	return mc
+}
+
+// URL returns the address the mock cluster manager is listening on.
+func (mc *mockCluster) URL() string {
+	return mc.server.URL
+}
+
+func (mc *mockCluster) Close() {
+	mc.kv.Close()
+	mc.server.Close()
+}
+
+// bucketStore returns the data store of the named bucket, or nil if the
+// bucket does not exist.
+func (mc *mockCluster) bucketStore(name string) *mockStore {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if b, ok := mc.buckets[name]; ok {
+		return b.store
+	}
+	return nil
+}
+
+func (mc *mockCluster) hostPort() (string, int) {
+	u, _ := url.Parse(mc.server.URL)
+	host, port, _ := net.SplitHostPort(u.Host)
+	p, _ := strconv.Atoi(port)
+	return host, p
+}
+
+// authenticate reports whether the credentials are valid. Clients may
+// authenticate as the administrator, as a local RBAC user or, for legacy SASL
+// authentication, with a bucket's name and password.
+func (mc *mockCluster) authenticate(user, pwd string) bool {
+	if user == mc.username {
+		return pwd == mc.password
+	} else if u, ok := mc.users[user]; ok {
+		return pwd == u.password
+	} else if b, ok := mc.buckets[user]; ok {
+		return pwd == b.password
+	}
+	return false
+}
+
+// canAccess reports whether an authenticated user may access the bucket. Only
+// the administrator may access cluster wide resources, which are requested
+// with an empty bucket name.
+func (mc *mockCluster) canAccess(user, bucket string) bool {
+	if user == mc.username {
+		return true
+	} else if bucket == "" {
+		return false
+	}
+
+	if u, ok := mc.users[user]; ok {
+		for _, role := range u.roles {
+			if strings.HasSuffix(role, "["+bucket+"]") || strings.HasSuffix(role, "[*]") {
+				return true
+			}
+		}
+		return false
+	}
+
+	return user == bucket
+}
+
+// dropBucketRoles removes the roles scoped to a bucket from every user, as the
+// cluster does when the bucket is deleted. Roles on all buckets are kept.
+func (mc *mockCluster) dropBucketRoles(bucket string) {
+	for _, u := range mc.users {
+		roles := u.roles[:0]
+		for _, role := range u.roles {
+			if !strings.HasSuffix(role, "["+bucket+"]") {
+				roles = append(roles, role)
+			}
+		}
+		u.roles = roles
+	}
+}
+
+func (mc *mockCluster) authorized(r *http.Request, bucket string) bool {
+	user, pwd, ok := r.BasicAuth()
+	return ok && mc.authenticate(user, pwd) && mc.canAccess(user, bucket)
+}
+
+func (mc *mockCluster) writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func (mc *mockCluster) unauthorized(w http.ResponseWriter) {
+	w.Header().Set("WWW-Authenticate", `Basic realm="Couchbase Server Admin / REST"`)
+	w.WriteHeader(http.StatusUnauthorized)
+}
+
+func (mc *mockCluster) handlePools(w http.ResponseWriter, r *http.Request) {
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"isAdminCreds":          true,
+		"isEnterprise":          true,
+		"implementationVersion": "5.0.0-0000-enterprise",
+		"pools": []map[string]string{
+			{
+				"name":         "default",
+				"uri":          "/pools/default?uuid=mock",
+				"streamingUri": "/poolsStreaming/default",
+			},
+		},
+	})
+}
+
+func (mc *mockCluster) handlePoolsDefault(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if user, pwd, ok := r.BasicAuth(); !ok || !mc.authenticate(user, pwd) {
+		mc.unauthorized(w)
+		return
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"name":            "default",
+		"nodes":           mc.nodes(""),
+		"buckets":         map[string]string{"uri": "/pools/default/buckets"},
+		"rebalanceStatus": "none",
+	})
+}
+
+func (mc *mockCluster) handleNodeServices(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"rev":      mc.rev,
+		"nodesExt": mc.nodesExt(),
+	})
+}
+
+func (mc *mockCluster) handleBuckets(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	user, pwd, ok := r.BasicAuth()
+	if !ok || !mc.authenticate(user, pwd) || (r.Method != "GET" && !mc.canAccess(user, "")) {
+		mc.unauthorized(w)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		// Users only see the buckets they have access to
+		names := make([]string, 0, len(mc.buckets))
+		for name := range mc.buckets {
+			if mc.canAccess(user, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		list := make([]map[string]interface{}, 0, len(names))
+		for _, name := range names {
+			list = append(list, mc.bucketConfig(mc.buckets[name]))
+		}
+		mc.writeJSON(w, http.StatusOK, list)
+	case "POST":
+		mc.createBucket(w, r)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (mc *mockCluster) createBucket(w http.ResponseWriter, r *http.Request) {
+	if err := r.ParseForm(); err != nil {
+		mc.writeJSON(w, http.StatusBadRequest, map[string]string{"_": err.Error()})
+		return
+	}
+
+	name := r.PostForm.Get("name")
+	if name == "" {
+		mc.writeJSON(w, http.StatusBadRequest,
+			map[string]interface{}{"errors": map[string]string{"name": "Bucket name cannot be empty"}})
+		return
+	} else if _, ok := mc.buckets[name]; ok {
+		mc.writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": map[string]string{"name": "Bucket with given name already exists"},
+		})
+		return
+	}
+
+	bucketType := r.PostForm.Get("bucketType")
+	if bucketType == "" || bucketType == "couchbase" {
+		bucketType = "membase"
+	}
+
+	// Each bucket type supports its own set of eviction policies, the first of
+	// which is the default.
+	policies := map[string][]string{
+		"membase":   {"valueOnly", "fullEviction"},
+		"ephemeral": {"noEviction", "nruEviction"},
+		"memcached": {""},
+	}
+
+	allowed, ok := policies[bucketType]
+	if !ok {
+		mc.writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": map[string]string{"bucketType": "invalid bucket type"},
+		})
+		return
+	}
+
+	eviction := r.PostForm.Get("evictionPolicy")
+	if eviction == "" {
+		eviction = allowed[0]
+	} else if !containsString(allowed, eviction) {
+		mc.writeJSON(w, http.StatusBadRequest, map[string]interface{}{
+			"errors": map[string]string{"evictionPolicy": "Eviction policy must be either " +
+				strings.Join(allowed, " or ")},
+		})
+		return
+	}
+
+	quota, _ := strconv.Atoi(r.PostForm.Get("ramQuotaMB"))
+	replicas, _ := strconv.Atoi(r.PostForm.Get("replicaNumber"))
+	maxTTL, _ := strconv.Atoi(r.PostForm.Get("maxTTL"))
+
+	mc.nextId++
+	mc.buckets[name] = &mockBucket{
+		name:               name,
+		uuid:               fmt.Sprintf("%032x", mc.nextId),
+		bucketType:         bucketType,
+		eviction:           eviction,
+		password:           r.PostForm.Get("saslPassword"),
+		quota:              quota,
+		replicas:           replicas,
+		flushEnabled:       r.PostForm.Get("flushEnabled") == "1",
+		indexReplicas:      r.PostForm.Get("replicaIndex") == "1",
+		conflictResolution: formValue(r, "conflictResolutionType", "seqno"),
+		compressionMode:    formValue(r, "compressionMode", "passive"),
+		maxTTL:             maxTTL,
+		durabilityMinLevel: formValue(r, "durabilityMinLevel", "none"),
+		ddocs:              make(map[string]json.RawMessage),
+		ddocRevs:           make(map[string]int),
+		indexes:            make(map[string]mockIndex),
+		store:              newMockStore(mockNumVBuckets),
+	}
+	mc.rev++
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (mc *mockCluster) handleBucket(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/pools/default/buckets/"), "/")
+	name := parts[0]
+
+	if !mc.authorized(r, name) {
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("Requested resource not found.\r\n"))
+		return
+	}
+
+	if len(parts) > 1 && parts[1] == "ddocs" {
+		mc.writeJSON(w, http.StatusOK, mc.ddocList(bucket))
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		mc.writeJSON(w, http.StatusOK, mc.bucketConfig(bucket))
+	case "DELETE":
+		delete(mc.buckets, name)
+		mc.dropFTSIndexes(name)
+		mc.dropBucketRoles(name)
+		mc.rev++
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (mc *mockCluster) handleTerseBucket(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	name := strings.TrimPrefix(r.URL.Path, "/pools/default/b/")
+	if !mc.authorized(r, name) {
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	mc.writeJSON(w, http.StatusOK, mc.bucketConfig(bucket))
+}
+
+// handleStreamingBucket sends a single bucket config followed by the four
+// newline terminator that streaming clients use to delimit configs. The
+// connection is then held open until either side goes away.
+func (mc *mockCluster) handleStreamingBucket(w http.ResponseWriter, r *http.Request) {
+	name := r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+
+	mc.mutex.Lock()
+	if !mc.authorized(r, name) {
+		mc.mutex.Unlock()
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		mc.mutex.Unlock()
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	data, _ := json.Marshal(mc.bucketConfig(bucket))
+	mc.mutex.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	w.Write(data)
+	w.Write([]byte("\n\n\n\n"))
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+
+	<-r.Context().Done()
+}
+
+// handleCouchBase serves the design document endpoints that a real cluster
+// exposes through the views (capi) port.
+func (mc *mockCluster) handleCouchBase(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	path := strings.TrimPrefix(r.URL.Path, "/couchBase/")
+	idx := strings.Index(path, "/_design/")
+	if idx == -1 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	name := path[:idx]
+	id := path[idx+1:]
+
+	if !mc.authorized(r, name) {
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		mc.writeJSON(w, http.StatusNotFound,
+			map[string]string{"error": "not_found", "reason": "missing"})
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		ddoc, ok := bucket.ddocs[id]
+		if !ok {
+			mc.writeJSON(w, http.StatusNotFound,
+				map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(ddoc)
+	case "PUT":
+		var body map[string]json.RawMessage
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			mc.writeJSON(w, http.StatusBadRequest,
+				map[string]string{"error": "bad_request", "reason": err.Error()})
+			return
+		}
+		delete(body, "_id")
+		delete(body, "_rev")
+
+		if reason := invalidDDoc(body); reason != "" {
+			mc.writeJSON(w, http.StatusBadRequest,
+				map[string]string{"error": "invalid_design_document", "reason": reason})
+			return
+		}
+
+		data, _ := json.Marshal(body)
+		bucket.ddocs[id] = data
+		bucket.ddocRevs[id]++
+		mc.writeJSON(w, http.StatusCreated, map[string]interface{}{"ok": true, "id": id})
+	case "DELETE":
+		if _, ok := bucket.ddocs[id]; !ok {
+			mc.writeJSON(w, http.StatusNotFound,
+				map[string]string{"error": "not_found", "reason": "missing"})
+			return
+		}
+		delete(bucket.ddocs, id)
+		delete(bucket.ddocRevs, id)
+		mc.writeJSON(w, http.StatusOK, map[string]interface{}{"ok": true, "id": id})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handleIndexStatus reports the GSI indexes on the cluster. Indexes are built
+// as soon as they are created, except for deferred indexes which are never
+// built.
+func (mc *mockCluster) handleIndexStatus(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if !mc.authorized(r, "") {
+		mc.unauthorized(w)
+		return
+	}
+
+	names := make([]string, 0, len(mc.buckets))
+	for name := range mc.buckets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	indexes := make([]map[string]interface{}, 0)
+	for _, name := range names {
+		for _, index := range sortedIndexes(mc.buckets[name]) {
+			status := "Ready"
+			if index.Deferred {
+				status = "Created"
+			}
+
+			indexes = append(indexes, map[string]interface{}{
+				"bucket":     index.Bucket,
+				"index":      index.Name,
+				"status":     status,
+				"definition": index.Definition,
+			})
+		}
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"indexes": indexes,
+		"version": 1,
+	})
+}
+
+// invalidDDoc returns why the cluster would refuse the design document, or an
+// empty string if it is valid. Only map functions are checked.
+func invalidDDoc(body map[string]json.RawMessage) string {
+	var views map[string]struct {
+		Map string `json:"map"`
+	}
+	if data, ok := body["views"]; ok {
+		if err := json.Unmarshal(data, &views); err != nil {
+			return "views must be an object: " + err.Error()
+		}
+	}
+
+	for name, view := range views {
+		if !strings.HasPrefix(strings.TrimSpace(view.Map), "function") {
+			return "map function of view " + name + " is not a function"
+		}
+	}
+
+	return ""
+}
+
+// putRawDDoc stores a design document without the validation a PUT is given,
+// like one written by an older server that accepted it.
+func (mc *mockCluster) putRawDDoc(bucket, id string, body []byte) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	b := mc.buckets[bucket]
+	b.ddocs[id] = body
+	b.ddocRevs[id]++
+}
+
+func (mc *mockCluster) ddocList(bucket *mockBucket) map[string]interface{} {
+	ids := make([]string, 0, len(bucket.ddocs))
+	for id := range bucket.ddocs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	rows := make([]map[string]interface{}, 0, len(ids))
+	for _, id := range ids {
+		rows = append(rows, map[string]interface{}{
+			"doc": map[string]interface{}{
+				"meta": map[string]string{
+					"id":  id,
+					"rev": fmt.Sprintf("%d-%08x", bucket.ddocRevs[id], bucket.ddocRevs[id]),
+				},
+				"json": bucket.ddocs[id],
+			},
+		})
+	}
+
+	return map[string]interface{}{"rows": rows}
+}
+
+func (mc *mockCluster) itemCount(bucket *mockBucket) uint64 {
+	return bucket.store.count()
+}
+
+func (mc *mockCluster) nodes(bucket string) []map[string]interface{} {
+	host, port := mc.hostPort()
+	addr := net.JoinHostPort(host, strconv.Itoa(port))
+
+	node := map[string]interface{}{
+		"hostname":          addr,
+		"status":            "healthy",
+		"clusterMembership": "active",
+		"version":           "5.0.0-0000-enterprise",
+		"services":          []string{"kv"},
+		"thisNode":          true,
+		"ports":             map[string]int{"direct": mc.kv.port()},
+	}
+
+	if bucket != "" {
+		node["couchApiBase"] = mc.server.URL + "/couchBase/" + bucket
+	}
+
+	return []map[string]interface{}{node}
+}
+
+func (mc *mockCluster) nodesExt() []map[string]interface{} {
+	host, port := mc.hostPort()
+
+	return []map[string]interface{}{{
+		"hostname": host,
+		"thisNode": true,
+		"services": map[string]int{
+			"mgmt":      port,
+			"capi":      port,
+			"kv":        mc.kv.port(),
+			"n1ql":      port,
+			"indexHttp": port,
+			"fts":       port,
+		},
+	}}
+}
+
+func (mc *mockCluster) bucketConfig(bucket *mockBucket) map[string]interface{} {
+	config := map[string]interface{}{
+		"rev":           mc.rev,
+		"name":          bucket.name,
+		"uuid":          bucket.uuid,
+		"bucketType":    bucket.bucketType,
+		"authType":      "sasl",
+		"saslPassword":  bucket.password,
+		"replicaNumber": bucket.replicas,
+		"replicaIndex":  bucket.indexReplicas,
+		"nodes":         mc.nodes(bucket.name),
+		"nodesExt":      mc.nodesExt(),
+		"uri":           "/pools/default/buckets/" + bucket.name + "?bucket_uuid=" + bucket.uuid,
+		"streamingUri":  "/pools/default/bucketsStreaming/" + bucket.name,
+		"ddocs":         map[string]string{"uri": "/pools/default/buckets/" + bucket.name + "/ddocs"},
+		"quota": map[string]int{
+			"ram":    bucket.quota * 1024 * 1024,
+			"rawRAM": bucket.quota * 1024 * 1024,
+		},
+		"basicStats": map[string]interface{}{
+			"itemCount": mc.itemCount(bucket),
+		},
+		"bucketCapabilities": []string{"cbhello", "touch", "couchapi", "cccp", "xdcrCheckpointing",
+			"nodesExt", "dcp", "xattr"},
+	}
+
+	if bucket.flushEnabled {
+		config["controllers"] = map[string]string{
+			"flush": "/pools/default/buckets/" + bucket.name + "/controller/doFlush",
+		}
+	}
+
+	if bucket.bucketType == "memcached" {
+		config["nodeLocator"] = "ketama"
+		return config
+	}
+
+	config["evictionPolicy"] = bucket.eviction
+	config["conflictResolutionType"] = bucket.conflictResolution
+	config["compressionMode"] = bucket.compressionMode
+	config["maxTTL"] = bucket.maxTTL
+	config["durabilityMinLevel"] = bucket.durabilityMinLevel
+
+	vbmap := make([][]int, mockNumVBuckets)
+	for i := range vbmap {
+		vbmap[i] = []int{0}
+	}
+
+	config["nodeLocator"] = "vbucket"
+	config["vBucketServerMap"] = map[string]interface{}{
+		"hashAlgorithm": "CRC",
+		"numReplicas":   bucket.replicas,
+		"serverList":    []string{mc.kv.address()},
+		"vBucketMap":    vbmap,
+	}
+
+	return config
+}
+
+// handleUser creates, replaces or deletes a local RBAC user. Roles are given
+// as a comma separated list.
+func (mc *mockCluster) handleUser(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if !mc.authorized(r, "") {
+		mc.unauthorized(w)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/settings/rbac/users/local/")
+	if name == "" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "PUT":
+		if err := r.ParseForm(); err != nil {
+			mc.writeJSON(w, http.StatusBadRequest, map[string]string{"_": err.Error()})
+			return
+		}
+
+		roles := make([]string, 0)
+		for _, role := range strings.Split(r.PostForm.Get("roles"), ",") {
+			if role = strings.TrimSpace(role); role != "" {
+				roles = append(roles, role)
+			}
+		}
+
+		mc.users[name] = &mockUser{password: r.PostForm.Get("password"), roles: roles}
+		w.WriteHeader(http.StatusOK)
+	case "DELETE":
+		if _, ok := mc.users[name]; !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		delete(mc.users, name)
+		w.WriteHeader(http.StatusOK)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func containsString(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
+
+// formValue returns the posted form value, or def if it was not given.
+func formValue(r *http.Request, key, def string) string {
+	if value := r.PostForm.Get(key); value != "" {
+		return value
+	}
+	return def
+}
@@ -0,0 +1,242 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/backup/couchbase"
+	"github.com/couchbase/backup/value"
+)
+
+func TestMockClusterBuckets(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	if !isBucketReady(mc.URL(), "default", t) {
+		t.Fatal("Expected default bucket to be ready")
+	}
+
+	items, err := getNumItems(mc.URL(), testCfg.Username, testCfg.Password, "default")
+	checkError(err, t)
+
+	if items != 0 {
+		t.Fatalf("Expected 0 items, got %d", items)
+	}
+
+	deleteBucket(mc.URL(), "default", t, false)
+
+	if isBucketReady(mc.URL(), "default", t) {
+		t.Fatal("Expected default bucket to be deleted")
+	}
+}
+
+func TestMockClusterAuth(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	req, err := http.NewRequest("GET", mc.URL()+"/pools/default/buckets", nil)
+	checkError(err, t)
+	req.SetBasicAuth(testCfg.Username, "badpassword")
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401, got %d", resp.StatusCode)
+	}
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+	createCouchbaseBucket(mc.URL(), "saslbucket", "saslpwd", t)
+	createBucketUser(mc.URL(), "backup-user", "userpwd", []string{"data_backup[default]"}, t)
+
+	expected := []struct {
+		user, password, bucket string
+		status                 int
+	}{
+		{"saslbucket", "saslpwd", "saslbucket", http.StatusOK},
+		{"saslbucket", "badpassword", "saslbucket", http.StatusUnauthorized},
+		{"saslbucket", "saslpwd", "default", http.StatusUnauthorized},
+		{"backup-user", "userpwd", "default", http.StatusOK},
+		{"backup-user", "userpwd", "saslbucket", http.StatusUnauthorized},
+		{"backup-user", "badpassword", "default", http.StatusUnauthorized},
+	}
+
+	for _, e := range expected {
+		req, err := http.NewRequest("GET", mc.URL()+"/pools/default/buckets/"+e.bucket, nil)
+		checkError(err, t)
+		req.SetBasicAuth(e.user, e.password)
+
+		resp, err := http.DefaultClient.Do(req)
+		checkError(err, t)
+		resp.Body.Close()
+
+		if resp.StatusCode != e.status {
+			t.Fatalf("Expected %s to get status %d for bucket %s, got %d", e.user, e.status,
+				e.bucket, resp.StatusCode)
+		}
+	}
+
+	// Deleting a bucket drops the roles scoped to it, even once it is recreated
+	deleteBucket(mc.URL(), "default", t, false)
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	req, err = http.NewRequest("GET", mc.URL()+"/pools/default/buckets/default", nil)
+	checkError(err, t)
+	req.SetBasicAuth("backup-user", "userpwd")
+
+	resp, err = http.DefaultClient.Do(req)
+	checkError(err, t)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("Expected status 401 for the recreated bucket, got %d", resp.StatusCode)
+	}
+}
+
+func TestMockClusterViews(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	rest := couchbase.CreateRestClient(mc.URL(), testCfg.Username, testCfg.Password, nil)
+
+	views := make(map[string]map[string]map[string]string)
+	views["views"] = make(map[string]map[string]string)
+	views["views"]["all"] = make(map[string]string)
+	views["views"]["all"]["map"] = "function (doc, meta) {\n emit(meta.id, null);\n}"
+
+	ddocs := []value.DDoc{value.DDoc{"_design/mock", "xxxxx", views}}
+	checkError(rest.PutViews("default", ddocs), t)
+
+	got, err := rest.GetViews("default")
+	checkError(err, t)
+
+	if len(got) != 1 {
+		t.Fatalf("Expected to get 1 view, got %d", len(got))
+	}
+}
+
+func TestMockClusterIndexes(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+	createCouchbaseBucket(mc.URL(), "other", "", t)
+
+	indexes := loadGSIIndexes(mc.URL(), "default", t)
+	waitForGSIIndexes(mc.URL(), "default", indexes, t)
+
+	expected := make(map[string]string)
+	for _, index := range indexes {
+		expected[index.Name] = index.Statement
+	}
+	verifyIndexDefinitions(mc.URL(), "default", expected, t)
+
+	indexURL := serviceURL(mc.URL(), "indexHttp", t)
+	request := func(method, path string, body io.Reader) []byte {
+		req, err := http.NewRequest(method, indexURL+path, body)
+		checkError(err, t)
+		req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+		resp, err := http.DefaultClient.Do(req)
+		checkError(err, t)
+		defer resp.Body.Close()
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s %s returned %d", method, path, resp.StatusCode)
+		}
+
+		data, err := ioutil.ReadAll(resp.Body)
+		checkError(err, t)
+		return data
+	}
+
+	// Restoring the metadata into another bucket recreates the indexes there
+	metadata := request("GET", "/getIndexMetadata?bucket=default", nil)
+	request("POST", "/restoreIndexMetadata?bucket=other", bytes.NewReader(metadata))
+	waitForGSIIndexes(mc.URL(), "other", indexes, t)
+
+	for name, definition := range expected {
+		expected[name] = strings.Replace(definition, "`default`", "`other`", -1)
+	}
+	verifyIndexDefinitions(mc.URL(), "other", expected, t)
+}
+
+func TestMockClusterFTSIndexes(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	t.Cleanup(mc.Close)
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	prefix := ftsIndexPrefix("default")
+	names := loadFTSIndexes(mc.URL(), "default", t)
+
+	expected := ftsDefinitions(mc.URL(), prefix, t)
+	if len(expected) != len(names) {
+		t.Fatalf("Expected %d FTS definitions, got %d", len(names), len(expected))
+	}
+
+	// Putting a definition back as it was read leaves it unchanged
+	searchURL := serviceURL(mc.URL(), "fts", t)
+	for name, definition := range expected {
+		data, err := json.Marshal(definition)
+		checkError(err, t)
+		putFTSIndex(searchURL, name, string(data), t)
+	}
+	verifyFTSDefinitions(mc.URL(), prefix, expected, nil, t)
+
+	// Deleting the bucket takes its indexes with it, but not the alias
+	deleteBucket(mc.URL(), "default", t, false)
+	if actual := ftsDefinitions(mc.URL(), prefix, t); len(actual) != 1 ||
+		actual[prefix+"alias"] == nil {
+		t.Fatalf("Expected only the FTS alias to be left, got %v", actual)
+	}
+}
+
+func TestMockClusterFailRequests(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+	mc.failRequests("/pools/default/buckets/default/ddocs")
+
+	get := func(path string) int {
+		req, err := http.NewRequest("GET", mc.URL()+path, nil)
+		checkError(err, t)
+		req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+		resp, err := http.DefaultClient.Do(req)
+		checkError(err, t)
+		resp.Body.Close()
+
+		return resp.StatusCode
+	}
+
+	// Requests the fault doesn't match are served as usual
+	if status := get("/pools/default/buckets/default"); status != http.StatusOK {
+		t.Fatalf("Expected bucket config to be served, got status %d", status)
+	}
+
+	status := get("/pools/default/buckets/default/ddocs")
+	if status != http.StatusInternalServerError {
+		t.Fatalf("Expected the injected fault to fail the request, got status %d", status)
+	}
+
+	// The fault disarms itself after firing
+	if status := get("/pools/default/buckets/default/ddocs"); status != http.StatusOK {
+		t.Fatalf("Expected the fault to fire only once, got status %d", status)
+	}
+
+	if fired := mc.faultsFired(); fired != 1 {
+		t.Fatalf("Expected 1 fault to fire, got %d", fired)
+	}
+}
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// mockFaults are failures the mock cluster injects to interrupt a running
+// backup. Each fault fires once and then disarms itself so that resuming the
+// backup can succeed.
+type mockFaults struct {
+	mutex sync.Mutex
+	// Number of DCP items to send before dropping the connection, or zero
+	dropAfter int
+	// VBucket whose stream drops the connection when it starts, or -1
+	dropVBucket int
+	// Path prefix of the next REST request to fail, or empty
+	failPath string
+	fired    int
+}
+
+// dropDcpAfter closes the DCP connection that streams the items'th item.
+func (mc *mockCluster) dropDcpAfter(items int) {
+	mc.faults.mutex.Lock()
+	defer mc.faults.mutex.Unlock()
+	mc.faults.dropAfter = items
+}
+
+// dropDcpAtVBucket closes the DCP connection that opens a stream for vb.
+func (mc *mockCluster) dropDcpAtVBucket(vb uint16) {
+	mc.faults.mutex.Lock()
+	defer mc.faults.mutex.Unlock()
+	mc.faults.dropVBucket = int(vb)
+}
+
+// failRequests fails the next REST request whose path starts with prefix with
+// an internal server error.
+func (mc *mockCluster) failRequests(prefix string) {
+	mc.faults.mutex.Lock()
+	defer mc.faults.mutex.Unlock()
+	mc.faults.failPath = prefix
+}
+
+// faultsFired returns the number of injected faults that have fired.
+func (mc *mockCluster) faultsFired() int {
+	mc.faults.mutex.Lock()
+	defer mc.faults.mutex.Unlock()
+	return mc.faults.fired
+}
+
+// dropStream reports whether the connection streaming vb should be dropped.
+// It is called when a stream starts and before each item is sent, with item
+// set accordingly.
+func (f *mockFaults) dropStream(vb uint16, item bool) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if !item && f.dropVBucket == int(vb) {
+		f.dropVBucket = -1
+		f.fired++
+		return true
+	}
+
+	if item && f.dropAfter > 0 {
+		f.dropAfter--
+		if f.dropAfter == 0 {
+			f.fired++
+			return true
+		}
+	}
+
+	return false
+}
+
+func (f *mockFaults) failRequest(path string) bool {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.failPath != "" && strings.HasPrefix(path, f.failPath) {
+		f.failPath = ""
+		f.fired++
+		return true
+	}
+	return false
+}
+
+// injectFaults wraps the REST API so that armed request faults fire.
+func (mc *mockCluster) injectFaults(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if mc.faults.failRequest(r.URL.Path) {
+			http.Error(w, "injected failure", http.StatusInternalServerError)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,107 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// mockFTSIndex is an FTS index or alias definition held by the mock search
+// service. Definitions are kept as generic JSON, as the search service stores
+// whatever settings it is given.
+type mockFTSIndex map[string]interface{}
+
+// handleFTSIndexes lists every FTS index and alias on the cluster.
+func (mc *mockCluster) handleFTSIndexes(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if !mc.authorized(r, "") {
+		mc.unauthorized(w)
+		return
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status": "ok",
+		"indexDefs": map[string]interface{}{
+			"uuid":        fmt.Sprintf("%016x", mc.rev),
+			"implVersion": "5.0.0",
+			"indexDefs":   mc.ftsIndexes,
+		},
+	})
+}
+
+// handleFTSIndex gets, creates or replaces, and deletes a single FTS index or
+// alias. Index names are global to the cluster.
+func (mc *mockCluster) handleFTSIndex(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if !mc.authorized(r, "") {
+		mc.unauthorized(w)
+		return
+	}
+
+	name := strings.TrimPrefix(r.URL.Path, "/api/index/")
+	index, exists := mc.ftsIndexes[name]
+
+	switch r.Method {
+	case "GET":
+		if !exists {
+			mc.ftsError(w, http.StatusNotFound, "index not found")
+			return
+		}
+		mc.writeJSON(w, http.StatusOK, map[string]interface{}{"status": "ok", "indexDef": index})
+	case "PUT":
+		index = make(mockFTSIndex)
+		if err := json.NewDecoder(r.Body).Decode(&index); err != nil {
+			mc.ftsError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+
+		if index["type"] == "fulltext-index" {
+			source, _ := index["sourceName"].(string)
+			bucket, ok := mc.buckets[source]
+			if !ok {
+				mc.ftsError(w, http.StatusBadRequest, "unknown source bucket "+source)
+				return
+			}
+			index["sourceUUID"] = bucket.uuid
+		}
+
+		mc.nextId++
+		delete(index, "prevIndexUUID")
+		index["name"] = name
+		index["uuid"] = fmt.Sprintf("%016x", mc.nextId)
+		mc.ftsIndexes[name] = index
+		mc.rev++
+
+		mc.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	case "DELETE":
+		if !exists {
+			mc.ftsError(w, http.StatusNotFound, "index not found")
+			return
+		}
+
+		delete(mc.ftsIndexes, name)
+		mc.rev++
+		mc.writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (mc *mockCluster) ftsError(w http.ResponseWriter, status int, msg string) {
+	mc.writeJSON(w, status, map[string]string{"status": "error", "error": msg})
+}
+
+// dropFTSIndexes deletes the FTS indexes on a bucket, as the search service
+// does when the bucket is deleted. Aliases are left alone.
+func (mc *mockCluster) dropFTSIndexes(bucket string) {
+	for name, index := range mc.ftsIndexes {
+		if index["type"] == "fulltext-index" && index["sourceName"] == bucket {
+			delete(mc.ftsIndexes, name)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// mockIndex is a GSI index held by the mock index service. The definition is
+// the statement the index was created with, which is what the index service
+// reports back and what a restore recreates it from.
+type mockIndex struct {
+	Name       string `json:"name"`
+	Bucket     string `json:"bucket"`
+	Definition string `json:"definition"`
+	Deferred   bool   `json:"deferred"`
+}
+
+// The CREATE INDEX statements the mock query service understands. Index
+// names and keyspaces may be quoted with backticks.
+var mockCreateIndex = regexp.MustCompile("(?is)^\\s*CREATE\\s+(PRIMARY\\s+)?INDEX\\s+" +
+	"(?:`?([\\w#]+)`?\\s+)?ON\\s+`?([\\w.%-]+)`?")
+
+// handleQuery runs CREATE INDEX statements against the mock index service. It
+// is the only kind of statement the tests send, so anything else is an error.
+func (mc *mockCluster) handleQuery(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	statement := r.FormValue("statement")
+	match := mockCreateIndex.FindStringSubmatch(statement)
+	if match == nil {
+		mc.queryError(w, http.StatusBadRequest, 3000, "Unsupported statement: "+statement)
+		return
+	}
+
+	name, bucketName := match[2], match[3]
+	if match[1] != "" && name == "" {
+		name = "#primary"
+	}
+
+	if !mc.authorized(r, bucketName) {
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[bucketName]
+	if !ok {
+		mc.queryError(w, http.StatusNotFound, 12003, "Keyspace not found "+bucketName)
+		return
+	} else if _, exists := bucket.indexes[name]; exists {
+		mc.queryError(w, http.StatusInternalServerError, 4300, "Index "+name+" already exists")
+		return
+	}
+
+	bucket.indexes[name] = mockIndex{
+		Name:       name,
+		Bucket:     bucketName,
+		Definition: strings.TrimSpace(statement),
+		Deferred:   strings.Contains(strings.Replace(statement, " ", "", -1), `"defer_build":true`),
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"status":  "success",
+		"results": []interface{}{},
+	})
+}
+
+func (mc *mockCluster) queryError(w http.ResponseWriter, status, code int, msg string) {
+	mc.writeJSON(w, status, map[string]interface{}{
+		"status": "errors",
+		"errors": []map[string]interface{}{{"code": code, "msg": msg}},
+	})
+}
+
+// handleGetIndexMetadata returns the definitions of the indexes on a bucket in
+// the form the restore sends back to handleRestoreIndexMetadata.
+func (mc *mockCluster) handleGetIndexMetadata(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	name := r.URL.Query().Get("bucket")
+	if !mc.authorized(r, name) {
+		mc.unauthorized(w)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		mc.writeJSON(w, http.StatusNotFound, map[string]string{"code": "error",
+			"error": "Bucket not found"})
+		return
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]interface{}{
+		"code":   "success",
+		"result": map[string]interface{}{"definitions": sortedIndexes(bucket)},
+	})
+}
+
+// handleRestoreIndexMetadata recreates index definitions in the bucket named
+// by the request, which need not be the bucket they were read from. Indexes
+// which already exist are left alone.
+func (mc *mockCluster) handleRestoreIndexMetadata(w http.ResponseWriter, r *http.Request) {
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	name := r.URL.Query().Get("bucket")
+	if !mc.authorized(r, name) {
+		mc.unauthorized(w)
+		return
+	}
+
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	bucket, ok := mc.buckets[name]
+	if !ok {
+		mc.writeJSON(w, http.StatusNotFound, map[string]string{"code": "error",
+			"error": "Bucket not found"})
+		return
+	}
+
+	// Accept the metadata either as returned by handleGetIndexMetadata or as
+	// just its result
+	var metadata struct {
+		Definitions []mockIndex `json:"definitions"`
+		Result      struct {
+			Definitions []mockIndex `json:"definitions"`
+		} `json:"result"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&metadata); err != nil {
+		mc.writeJSON(w, http.StatusBadRequest, map[string]string{"code": "error",
+			"error": err.Error()})
+		return
+	}
+
+	for _, index := range append(metadata.Definitions, metadata.Result.Definitions...) {
+		if _, exists := bucket.indexes[index.Name]; exists {
+			continue
+		}
+
+		if index.Bucket != name {
+			index.Definition = strings.Replace(index.Definition, "`"+index.Bucket+"`",
+				"`"+name+"`", -1)
+			index.Bucket = name
+		}
+		bucket.indexes[index.Name] = index
+	}
+
+	mc.writeJSON(w, http.StatusOK, map[string]string{"code": "success"})
+}
+
+// sortedIndexes returns the indexes on the bucket ordered by name.
+func sortedIndexes(bucket *mockBucket) []mockIndex {
+	indexes := make([]mockIndex, 0, len(bucket.indexes))
+	for _, index := range bucket.indexes {
+		indexes = append(indexes, index)
+	}
+	sort.Slice(indexes, func(i, j int) bool { return indexes[i].Name < indexes[j].Name })
+
+	return indexes
+}
@@ -0,0 +1,454 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"sync"
+	"time"
+)
+
+// mockMemcached is an in-process stand-in for the data service. It speaks
+// enough of the memcached binary protocol (including DCP) for the data loader,
+// backup and restore to move documents in and out of a mockCluster.
+type mockMemcached struct {
+	cluster  *mockCluster
+	listener net.Listener
+	wg       sync.WaitGroup
+}
+
+func newMockMemcached(mc *mockCluster) (*mockMemcached, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	mm := &mockMemcached{cluster: mc, listener: listener}
+	mm.wg.Add(1)
+	go mm.accept()
+
+	return mm, nil
+}
+
+func (mm *mockMemcached) address() string {
+	return mm.listener.Addr().String()
+}
+
+func (mm *mockMemcached) port() int {
+	return mm.listener.Addr().(*net.TCPAddr).Port
+}
+
+func (mm *mockMemcached) Close() {
+	mm.listener.Close()
+	mm.wg.Wait()
+}
+
+func (mm *mockMemcached) accept() {
+	defer mm.wg.Done()
+	for {
+		conn, err := mm.listener.Accept()
+		if err != nil {
+			return
+		}
+		c := &mcConn{server: mm, conn: conn, writer: bufio.NewWriter(conn)}
+		go c.serve()
+	}
+}
+
+// mcConn holds the per-connection state of a data service client.
+type mcConn struct {
+	server *mockMemcached
+	conn   net.Conn
+
+	wmutex sync.Mutex
+	writer *bufio.Writer
+
+	user   string
+	authed bool
+	bucket *mockBucket
+	dcp    bool
+}
+
+func (c *mcConn) write(p *mcPacket) error {
+	c.wmutex.Lock()
+	defer c.wmutex.Unlock()
+
+	if _, err := c.writer.Write(p.bytes()); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
+
+func (c *mcConn) respond(req *mcPacket, status uint16, extras, value []byte, cas uint64) {
+	c.write(&mcPacket{
+		magic:   mcResMagic,
+		opcode:  req.opcode,
+		vbucket: status,
+		opaque:  req.opaque,
+		cas:     cas,
+		extras:  extras,
+		value:   value,
+	})
+}
+
+func (c *mcConn) serve() {
+	defer c.conn.Close()
+
+	reader := bufio.NewReader(c.conn)
+	for {
+		req, err := readPacket(reader)
+		if err != nil {
+			return
+		}
+
+		if req.magic != mcReqMagic {
+			// Responses to server initiated DCP messages, e.g. DCP_NOOP.
+			continue
+		}
+
+		if !c.handle(req) {
+			return
+		}
+	}
+}
+
+// handle processes a single request and returns false if the connection
+// should be closed.
+func (c *mcConn) handle(req *mcPacket) bool {
+	switch req.opcode {
+	case mcHello:
+		c.respond(req, mcStatusSuccess, nil, nil, 0)
+		return true
+	case mcSaslListMechs:
+		c.respond(req, mcStatusSuccess, nil, []byte("PLAIN"), 0)
+		return true
+	case mcSaslAuth:
+		c.handleAuth(req)
+		return true
+	case mcGetErrorMap:
+		c.respond(req, mcStatusUnknownCmd, nil, nil, 0)
+		return true
+	case mcNoop, mcDcpControl, mcDcpBufferAck:
+		c.respond(req, mcStatusSuccess, nil, nil, 0)
+		return true
+	}
+
+	if !c.authed {
+		c.respond(req, mcStatusAuthError, nil, nil, 0)
+		return true
+	}
+
+	switch req.opcode {
+	case mcSelectBucket:
+		c.handleSelectBucket(req)
+		return true
+	case mcGetClusterConf:
+		c.handleClusterConfig(req)
+		return true
+	}
+
+	if c.bucket == nil {
+		c.respond(req, mcStatusNoBucket, nil, nil, 0)
+		return true
+	}
+
+	switch req.opcode {
+	case mcGet:
+		c.handleGet(req)
+	case mcSet, mcAdd, mcReplace:
+		c.handleStore(req)
+	case mcDelete:
+		c.handleDelete(req)
+	case mcSetWithMeta, mcDelWithMeta:
+		c.handleWithMeta(req)
+	case mcGetAllVBSeqnos:
+		c.handleAllVBSeqnos(req)
+	case mcDcpOpen:
+		c.dcp = true
+		c.respond(req, mcStatusSuccess, nil, nil, 0)
+	case mcDcpFailoverLog:
+		c.handleFailoverLog(req)
+	case mcDcpStreamReq:
+		c.handleStreamReq(req)
+	case mcDcpCloseStream:
+		c.respond(req, mcStatusSuccess, nil, nil, 0)
+	default:
+		c.respond(req, mcStatusUnknownCmd, nil, nil, 0)
+	}
+
+	return true
+}
+
+func (c *mcConn) handleAuth(req *mcPacket) {
+	if string(req.key) != "PLAIN" {
+		c.respond(req, mcStatusAuthError, nil, nil, 0)
+		return
+	}
+
+	parts := bytes.Split(req.value, []byte{0})
+	if len(parts) != 3 {
+		c.respond(req, mcStatusAuthError, nil, nil, 0)
+		return
+	}
+
+	user, pwd := string(parts[1]), string(parts[2])
+
+	mc := c.server.cluster
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	if mc.authenticate(user, pwd) {
+		c.user = user
+		c.authed = true
+
+		// Legacy bucket level authentication selects the bucket implicitly
+		if _, ok := mc.users[user]; !ok && user != mc.username {
+			c.bucket = mc.buckets[user]
+		}
+	}
+
+	if !c.authed {
+		c.respond(req, mcStatusAuthError, nil, nil, 0)
+		return
+	}
+
+	c.respond(req, mcStatusSuccess, nil, []byte("Authenticated"), 0)
+}
+
+func (c *mcConn) handleSelectBucket(req *mcPacket) {
+	mc := c.server.cluster
+	mc.mutex.Lock()
+	defer mc.mutex.Unlock()
+
+	b, ok := mc.buckets[string(req.key)]
+	if !ok || b.store == nil {
+		c.respond(req, mcStatusKeyNotFound, nil, nil, 0)
+		return
+	} else if !mc.canAccess(c.user, b.name) {
+		c.respond(req, mcStatusAccess, nil, nil, 0)
+		return
+	}
+
+	c.bucket = b
+	c.respond(req, mcStatusSuccess, nil, nil, 0)
+}
+
+func (c *mcConn) handleClusterConfig(req *mcPacket) {
+	if c.bucket == nil {
+		c.respond(req, mcStatusNoBucket, nil, nil, 0)
+		return
+	}
+
+	mc := c.server.cluster
+	mc.mutex.Lock()
+	data, _ := json.Marshal(mc.bucketConfig(c.bucket))
+	mc.mutex.Unlock()
+
+	c.respond(req, mcStatusSuccess, nil, data, 0)
+}
+
+func (c *mcConn) validVBucket(req *mcPacket) bool {
+	if int(req.vbucket) >= len(c.bucket.store.vbuckets) {
+		c.respond(req, mcStatusInvalid, nil, nil, 0)
+		return false
+	}
+	return true
+}
+
+func (c *mcConn) handleGet(req *mcPacket) {
+	if !c.validVBucket(req) {
+		return
+	}
+
+	item, ok := c.bucket.store.get(req.vbucket, string(req.key))
+	if !ok {
+		c.respond(req, mcStatusKeyNotFound, nil, nil, 0)
+		return
+	}
+
+	extras := make([]byte, 4)
+	binary.BigEndian.PutUint32(extras, item.flags)
+	c.write(&mcPacket{
+		magic:    mcResMagic,
+		opcode:   req.opcode,
+		datatype: item.datatype,
+		opaque:   req.opaque,
+		cas:      item.cas,
+		extras:   extras,
+		value:    item.value,
+	})
+}
+
+func (c *mcConn) handleStore(req *mcPacket) {
+	if !c.validVBucket(req) {
+		return
+	} else if len(req.extras) != 8 {
+		c.respond(req, mcStatusInvalid, nil, nil, 0)
+		return
+	}
+
+	flags := binary.BigEndian.Uint32(req.extras[0:4])
+	expiry := cappedExpiry(binary.BigEndian.Uint32(req.extras[4:8]), c.bucket.maxTTL)
+
+	cas, status := c.bucket.store.store(req.opcode, req.vbucket, string(req.key), req.value,
+		flags, expiry, req.datatype, req.cas)
+	c.respond(req, status, nil, nil, cas)
+}
+
+func (c *mcConn) handleDelete(req *mcPacket) {
+	if !c.validVBucket(req) {
+		return
+	}
+
+	cas, status := c.bucket.store.remove(req.vbucket, string(req.key), req.cas)
+	c.respond(req, status, nil, nil, cas)
+}
+
+// handleWithMeta applies SET_WITH_META and DEL_WITH_META, which is how the
+// restore writes documents while preserving their metadata.
+func (c *mcConn) handleWithMeta(req *mcPacket) {
+	if !c.validVBucket(req) {
+		return
+	} else if len(req.extras) < 24 {
+		c.respond(req, mcStatusInvalid, nil, nil, 0)
+		return
+	}
+
+	flags := binary.BigEndian.Uint32(req.extras[0:4])
+	expiry := binary.BigEndian.Uint32(req.extras[4:8])
+	if req.opcode == mcSetWithMeta {
+		// The bucket max TTL applies to mutations with metadata too
+		expiry = cappedExpiry(expiry, c.bucket.maxTTL)
+	}
+	revSeqno := binary.BigEndian.Uint64(req.extras[8:16])
+	cas := binary.BigEndian.Uint64(req.extras[16:24])
+
+	force := false
+	if len(req.extras) >= 28 {
+		force = binary.BigEndian.Uint32(req.extras[24:28])&mcSkipConflictResolution != 0
+	}
+
+	status := c.bucket.store.storeWithMeta(req.vbucket, string(req.key), req.value, flags,
+		expiry, req.datatype, revSeqno, cas, req.opcode == mcDelWithMeta, force)
+	c.respond(req, status, nil, nil, 0)
+}
+
+func (c *mcConn) handleAllVBSeqnos(req *mcPacket) {
+	seqnos := c.bucket.store.highSeqnos()
+
+	body := make([]byte, 0, len(seqnos)*10)
+	for vb, seqno := range seqnos {
+		entry := make([]byte, 10)
+		binary.BigEndian.PutUint16(entry[0:2], uint16(vb))
+		binary.BigEndian.PutUint64(entry[2:10], seqno)
+		body = append(body, entry...)
+	}
+
+	c.respond(req, mcStatusSuccess, nil, body, 0)
+}
+
+func (c *mcConn) failoverLog(vb uint16) []byte {
+	uuid, _ := c.bucket.store.vbucketState(vb)
+	log := make([]byte, 16)
+	binary.BigEndian.PutUint64(log[0:8], uuid)
+	binary.BigEndian.PutUint64(log[8:16], 0)
+	return log
+}
+
+func (c *mcConn) handleFailoverLog(req *mcPacket) {
+	if !c.validVBucket(req) {
+		return
+	}
+	c.respond(req, mcStatusSuccess, nil, c.failoverLog(req.vbucket), 0)
+}
+
+// handleStreamReq validates a DCP stream request and then sends a single disk
+// snapshot containing every item in the requested range, followed by a
+// stream end message.
+func (c *mcConn) handleStreamReq(req *mcPacket) {
+	if !c.dcp {
+		c.respond(req, mcStatusInvalid, nil, nil, 0)
+		return
+	} else if !c.validVBucket(req) {
+		return
+	} else if len(req.extras) != 48 {
+		c.respond(req, mcStatusInvalid, nil, nil, 0)
+		return
+	}
+
+	start := binary.BigEndian.Uint64(req.extras[8:16])
+	end := binary.BigEndian.Uint64(req.extras[16:24])
+	vbuuid := binary.BigEndian.Uint64(req.extras[24:32])
+
+	uuid, high := c.bucket.store.vbucketState(req.vbucket)
+	if start > high || (start > 0 && vbuuid != uuid) {
+		rollback := make([]byte, 8)
+		c.respond(req, mcStatusRollback, nil, rollback, 0)
+		return
+	}
+
+	if end > high {
+		end = high
+	}
+
+	c.respond(req, mcStatusSuccess, nil, c.failoverLog(req.vbucket), 0)
+
+	items, _ := c.bucket.store.snapshot(req.vbucket, start, end)
+	go c.stream(req.vbucket, req.opaque, start, end, items)
+}
+
+func (c *mcConn) stream(vb uint16, opaque uint32, start, end uint64, items []mockItem) {
+	faults := &c.server.cluster.faults
+	if faults.dropStream(vb, false) {
+		c.conn.Close()
+		return
+	}
+
+	if start < end {
+		extras := make([]byte, 20)
+		binary.BigEndian.PutUint64(extras[0:8], start)
+		binary.BigEndian.PutUint64(extras[8:16], end)
+		binary.BigEndian.PutUint32(extras[16:20], 0x02)
+		if c.write(&mcPacket{magic: mcReqMagic, opcode: mcDcpSnapshot, vbucket: vb,
+			opaque: opaque, extras: extras}) != nil {
+			return
+		}
+	}
+
+	for _, item := range items {
+		if faults.dropStream(vb, true) {
+			c.conn.Close()
+			return
+		}
+		if c.write(dcpItemPacket(vb, opaque, item)) != nil {
+			return
+		}
+	}
+
+	c.write(&mcPacket{magic: mcReqMagic, opcode: mcDcpStreamEnd, vbucket: vb, opaque: opaque,
+		extras: make([]byte, 4)})
+}
+
+// dcpItemPacket encodes an item as a DCP message. Items that have expired but
+// not yet been purged are sent as deletions, as the data service does when
+// backfilling them.
+func dcpItemPacket(vb uint16, opaque uint32, item mockItem) *mcPacket {
+	if item.deleted || item.expired(time.Now()) {
+		extras := make([]byte, 18)
+		binary.BigEndian.PutUint64(extras[0:8], item.seqno)
+		binary.BigEndian.PutUint64(extras[8:16], item.revSeqno)
+		return &mcPacket{magic: mcReqMagic, opcode: mcDcpDeletion, vbucket: vb, opaque: opaque,
+			cas: item.cas, extras: extras, key: []byte(item.key)}
+	}
+
+	extras := make([]byte, 31)
+	binary.BigEndian.PutUint64(extras[0:8], item.seqno)
+	binary.BigEndian.PutUint64(extras[8:16], item.revSeqno)
+	binary.BigEndian.PutUint32(extras[16:20], item.flags)
+	binary.BigEndian.PutUint32(extras[20:24], item.expiry)
+	return &mcPacket{magic: mcReqMagic, opcode: mcDcpMutation, datatype: item.datatype,
+		vbucket: vb, opaque: opaque, cas: item.cas, extras: extras, key: []byte(item.key),
+		value: item.value}
+}
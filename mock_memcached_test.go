@@ -0,0 +1,119 @@
+package tests
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+)
+
+func mcRequest(conn net.Conn, req *mcPacket, t *testing.T) *mcPacket {
+	req.magic = mcReqMagic
+	_, err := conn.Write(req.bytes())
+	checkError(err, t)
+
+	resp, err := readPacket(conn)
+	checkError(err, t)
+
+	return resp
+}
+
+func mcConnect(mc *mockCluster, bucket string, t *testing.T) net.Conn {
+	conn, err := net.Dial("tcp", mc.kv.address())
+	checkError(err, t)
+
+	auth := []byte("\x00" + testCfg.Username + "\x00" + testCfg.Password)
+	resp := mcRequest(conn, &mcPacket{opcode: mcSaslAuth, key: []byte("PLAIN"), value: auth}, t)
+	if resp.vbucket != mcStatusSuccess {
+		t.Fatalf("Expected authentication to succeed, got status %d", resp.vbucket)
+	}
+
+	resp = mcRequest(conn, &mcPacket{opcode: mcSelectBucket, key: []byte(bucket)}, t)
+	if resp.vbucket != mcStatusSuccess {
+		t.Fatalf("Expected select bucket to succeed, got status %d", resp.vbucket)
+	}
+
+	return conn
+}
+
+func TestMockMemcachedSetGet(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	conn := mcConnect(mc, "default", t)
+	defer conn.Close()
+
+	store := mc.bucketStore("default")
+	vb := store.vbucketForKey("key")
+
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[0:4], 0x02000000)
+	resp := mcRequest(conn, &mcPacket{opcode: mcSet, vbucket: vb, extras: extras,
+		key: []byte("key"), value: []byte(`{"x":1}`)}, t)
+	if resp.vbucket != mcStatusSuccess {
+		t.Fatalf("Expected set to succeed, got status %d", resp.vbucket)
+	}
+
+	resp = mcRequest(conn, &mcPacket{opcode: mcAdd, vbucket: vb, extras: extras,
+		key: []byte("key"), value: []byte(`{"x":2}`)}, t)
+	if resp.vbucket != mcStatusKeyExists {
+		t.Fatalf("Expected add of existing key to fail, got status %d", resp.vbucket)
+	}
+
+	resp = mcRequest(conn, &mcPacket{opcode: mcGet, vbucket: vb, key: []byte("key")}, t)
+	if resp.vbucket != mcStatusSuccess || string(resp.value) != `{"x":1}` {
+		t.Fatalf("Expected to get the stored value, got status %d", resp.vbucket)
+	}
+
+	items, err := getNumItems(mc.URL(), testCfg.Username, testCfg.Password, "default")
+	checkError(err, t)
+
+	if items != 1 {
+		t.Fatalf("Expected 1 item, got %d", items)
+	}
+}
+
+func TestMockMemcachedDcpStream(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	store := mc.bucketStore("default")
+	vb := store.vbucketForKey("a")
+	store.store(mcSet, vb, "a", []byte("1"), 0, 0, 0, 0)
+	store.store(mcSet, vb, "a", []byte("2"), 0, 0, 0, 0)
+	store.storeWithMeta(vb, "b", nil, 0, 0, 0, 5, 100, true, true)
+
+	conn := mcConnect(mc, "default", t)
+	defer conn.Close()
+
+	resp := mcRequest(conn, &mcPacket{opcode: mcDcpOpen, extras: make([]byte, 8),
+		key: []byte("mock-test")}, t)
+	if resp.vbucket != mcStatusSuccess {
+		t.Fatalf("Expected DCP open to succeed, got status %d", resp.vbucket)
+	}
+
+	extras := make([]byte, 48)
+	binary.BigEndian.PutUint64(extras[16:24], 0xffffffffffffffff)
+	resp = mcRequest(conn, &mcPacket{opcode: mcDcpStreamReq, vbucket: vb, opaque: 7,
+		extras: extras}, t)
+	if resp.vbucket != mcStatusSuccess {
+		t.Fatalf("Expected stream request to succeed, got status %d", resp.vbucket)
+	}
+
+	expected := []uint8{mcDcpSnapshot, mcDcpMutation, mcDcpDeletion, mcDcpStreamEnd}
+	for _, opcode := range expected {
+		msg, err := readPacket(conn)
+		checkError(err, t)
+
+		if msg.opcode != opcode {
+			t.Fatalf("Expected DCP opcode %x, got %x", opcode, msg.opcode)
+		}
+
+		if msg.opcode == mcDcpMutation && string(msg.value) != "2" {
+			t.Fatalf("Expected latest revision of `a`, got %s", string(msg.value))
+		}
+	}
+}
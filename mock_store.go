@@ -0,0 +1,287 @@
+package tests
+
+import (
+	"hash/crc32"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Relative expiry times larger than this are treated as absolute unix
+// timestamps, matching the behaviour of the data service.
+const mockMaxRelativeExpiry = 60 * 60 * 24 * 30
+
+// mockItem is a single document, or tombstone, held by the mock data service.
+type mockItem struct {
+	key      string
+	value    []byte
+	flags    uint32
+	expiry   uint32
+	datatype uint8
+	cas      uint64
+	revSeqno uint64
+	seqno    uint64
+	deleted  bool
+}
+
+func (i *mockItem) expired(now time.Time) bool {
+	return i.expiry != 0 && int64(i.expiry) <= now.Unix()
+}
+
+type mockVBucket struct {
+	uuid      uint64
+	highSeqno uint64
+	items     map[string]*mockItem
+}
+
+// mockStore is the in-memory vbucket store backing a single mock bucket. It
+// keeps only the latest revision of each key, so DCP streams served from it
+// always look like a fully de-duplicated disk snapshot.
+type mockStore struct {
+	mutex    sync.Mutex
+	vbuckets []*mockVBucket
+	lastCas  uint64
+}
+
+func newMockStore(vbuckets int) *mockStore {
+	s := &mockStore{vbuckets: make([]*mockVBucket, vbuckets)}
+	for i := range s.vbuckets {
+		s.vbuckets[i] = &mockVBucket{
+			uuid:  uint64(rand.Int63()),
+			items: make(map[string]*mockItem),
+		}
+	}
+	return s
+}
+
+// vbucketForKey uses the same CRC32 hashing clients use to place keys.
+func (s *mockStore) vbucketForKey(key string) uint16 {
+	crc := crc32.ChecksumIEEE([]byte(key))
+	return uint16(((crc >> 16) & 0x7fff) % uint32(len(s.vbuckets)))
+}
+
+func (s *mockStore) nextCas() uint64 {
+	cas := uint64(time.Now().UnixNano())
+	if cas <= s.lastCas {
+		cas = s.lastCas + 1
+	}
+	s.lastCas = cas
+	return cas
+}
+
+func absoluteExpiry(expiry uint32) uint32 {
+	if expiry == 0 || expiry > mockMaxRelativeExpiry {
+		return expiry
+	}
+	return uint32(time.Now().Unix()) + expiry
+}
+
+// cappedExpiry converts the expiry to an absolute time and applies the bucket
+// max TTL to it, if there is one. Documents that would never expire, or would
+// live longer than the max TTL, expire max TTL seconds from now.
+func cappedExpiry(expiry uint32, maxTTL int) uint32 {
+	expiry = absoluteExpiry(expiry)
+	if maxTTL <= 0 {
+		return expiry
+	}
+
+	limit := uint32(time.Now().Unix()) + uint32(maxTTL)
+	if expiry == 0 || expiry > limit {
+		return limit
+	}
+	return expiry
+}
+
+func (s *mockStore) live(vb uint16, key string) *mockItem {
+	item, ok := s.vbuckets[vb].items[key]
+	if !ok || item.deleted || item.expired(time.Now()) {
+		return nil
+	}
+	return item
+}
+
+func (s *mockStore) get(vb uint16, key string) (mockItem, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if item := s.live(vb, key); item != nil {
+		return *item, true
+	}
+	return mockItem{}, false
+}
+
+// store applies a front end SET/ADD/REPLACE and returns the new CAS.
+func (s *mockStore) store(opcode uint8, vb uint16, key string, value []byte, flags,
+	expiry uint32, datatype uint8, cas uint64) (uint64, uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing := s.live(vb, key)
+	switch {
+	case opcode == mcAdd && existing != nil:
+		return 0, mcStatusKeyExists
+	case opcode == mcReplace && existing == nil:
+		return 0, mcStatusKeyNotFound
+	case cas != 0 && existing == nil:
+		return 0, mcStatusKeyNotFound
+	case cas != 0 && existing.cas != cas:
+		return 0, mcStatusKeyExists
+	}
+
+	v := s.vbuckets[vb]
+	revSeqno := uint64(1)
+	if prev, ok := v.items[key]; ok {
+		revSeqno = prev.revSeqno + 1
+	}
+
+	v.highSeqno++
+	item := &mockItem{
+		key:      key,
+		value:    append([]byte(nil), value...),
+		flags:    flags,
+		expiry:   absoluteExpiry(expiry),
+		datatype: datatype,
+		cas:      s.nextCas(),
+		revSeqno: revSeqno,
+		seqno:    v.highSeqno,
+	}
+	v.items[key] = item
+
+	return item.cas, mcStatusSuccess
+}
+
+func (s *mockStore) remove(vb uint16, key string, cas uint64) (uint64, uint16) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	existing := s.live(vb, key)
+	if existing == nil {
+		return 0, mcStatusKeyNotFound
+	} else if cas != 0 && existing.cas != cas {
+		return 0, mcStatusKeyExists
+	}
+
+	v := s.vbuckets[vb]
+	v.highSeqno++
+	existing.value = nil
+	existing.deleted = true
+	existing.revSeqno++
+	existing.cas = s.nextCas()
+	existing.seqno = v.highSeqno
+
+	return existing.cas, mcStatusSuccess
+}
+
+// storeWithMeta applies a SET_WITH_META or DEL_WITH_META. Unless force is set
+// the incoming revision only wins if it has a higher revision sequence number
+// (or the same revision and a higher CAS) than the one already stored.
+func (s *mockStore) storeWithMeta(vb uint16, key string, value []byte, flags, expiry uint32,
+	datatype uint8, revSeqno, cas uint64, deleted, force bool) uint16 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v := s.vbuckets[vb]
+	if prev, ok := v.items[key]; ok && !force {
+		if prev.revSeqno > revSeqno || (prev.revSeqno == revSeqno && prev.cas >= cas) {
+			return mcStatusKeyExists
+		}
+	}
+
+	v.highSeqno++
+	if cas > s.lastCas {
+		s.lastCas = cas
+	}
+
+	item := &mockItem{
+		key:      key,
+		flags:    flags,
+		expiry:   expiry,
+		datatype: datatype,
+		cas:      cas,
+		revSeqno: revSeqno,
+		seqno:    v.highSeqno,
+		deleted:  deleted,
+	}
+	if !deleted {
+		item.value = append([]byte(nil), value...)
+	}
+	v.items[key] = item
+
+	return mcStatusSuccess
+}
+
+// snapshot returns the items in a vbucket with a seqno in (start, end],
+// ordered by seqno, along with the vbucket's current high seqno.
+func (s *mockStore) snapshot(vb uint16, start, end uint64) ([]mockItem, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	v := s.vbuckets[vb]
+	items := make([]mockItem, 0)
+	for _, item := range v.items {
+		if item.seqno > start && item.seqno <= end {
+			items = append(items, *item)
+		}
+	}
+
+	sort.Slice(items, func(i, j int) bool {
+		return items[i].seqno < items[j].seqno
+	})
+
+	return items, v.highSeqno
+}
+
+func (s *mockStore) vbucketState(vb uint16) (uint64, uint64) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	return s.vbuckets[vb].uuid, s.vbuckets[vb].highSeqno
+}
+
+func (s *mockStore) highSeqnos() []uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	seqnos := make([]uint64, len(s.vbuckets))
+	for i, v := range s.vbuckets {
+		seqnos[i] = v.highSeqno
+	}
+	return seqnos
+}
+
+// count returns the number of live documents, which is what the cluster
+// manager reports as the bucket item count.
+func (s *mockStore) count() uint64 {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	count := uint64(0)
+	for _, v := range s.vbuckets {
+		for _, item := range v.items {
+			if !item.deleted && !item.expired(now) {
+				count++
+			}
+		}
+	}
+	return count
+}
+
+// items returns a copy of every live document in the store keyed by
+// document key.
+func (s *mockStore) items() map[string]mockItem {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	items := make(map[string]mockItem)
+	for _, v := range s.vbuckets {
+		for key, item := range v.items {
+			if !item.deleted && !item.expired(now) {
+				items[key] = *item
+			}
+		}
+	}
+	return items
+}
@@ -0,0 +1,114 @@
+package tests
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that running a backup with purge set removes a backup which was
+// abandoned part way through and then takes a fresh backup. Each case runs
+// against its own mock cluster so that the injected faults only affect the
+// backup under test.
+func TestBackupPurge(t *testing.T) {
+	cases := []struct {
+		name string
+		// Whether a complete backup is taken before the abandoned one
+		incremental bool
+	}{
+		{"AbandonedFull", false},
+		{"AbandonedIncremental", true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			mc := newMockCluster(testCfg.Username, testCfg.Password)
+			t.Cleanup(mc.Close)
+
+			host, bucket, backupName := mc.URL(), "default", "purge-test"
+			createCouchbaseBucket(host, bucket, "", t)
+
+			config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+			checkError(err, t)
+
+			dir := t.TempDir()
+			a, err := archive.MountArchive(dir, true)
+			checkError(err, t)
+
+			checkError(a.CreateRepo(backupName, config), t)
+
+			model := newShadowModel()
+			model.loadData(host, testCfg.Username, testCfg.Password, bucket, 5000, "full",
+				false, t)
+
+			expectedBackups := 1
+			if c.incremental {
+				name, err := executeBackup(a, backupName, "archive", host, testCfg.Username,
+					testCfg.Password, 4, false, false)
+				checkError(err, t)
+				model.backup(name)
+				expectedBackups++
+
+				model.loadData(host, testCfg.Username, testCfg.Password, bucket, 3000, "incr",
+					false, t)
+			}
+
+			expected := takeSnapshot(host, bucket, t)
+
+			mc.dropDcpAfter(1000)
+			partial := abandonBackup(mc, a, backupName, t)
+
+			partialDir := filepath.Join(dir, backupName, partial)
+			if _, err := os.Stat(partialDir); err != nil {
+				t.Fatalf("Expected the abandoned backup to be left at %s: %s", partialDir,
+					err.Error())
+			}
+
+			name, err := executeBackup(a, backupName, "archive", host, testCfg.Username,
+				testCfg.Password, 4, false, true)
+			checkError(err, t)
+			model.backup(name)
+
+			if name == partial {
+				t.Fatal("Expected a fresh backup, but the abandoned backup was resumed")
+			}
+
+			if _, err := os.Stat(partialDir); !os.IsNotExist(err) {
+				t.Fatalf("Expected the abandoned backup %s to be purged", partialDir)
+			}
+
+			rinfo, err := a.RepoInfo(backupName)
+			checkError(err, t)
+			if rinfo.NumBackups != expectedBackups {
+				t.Fatalf("Expected %d backups after purge, got %d", expectedBackups,
+					rinfo.NumBackups)
+			}
+
+			info, err := a.BackupInfo(backupName, name)
+			checkError(err, t)
+
+			count := info[bucket].NumDocs
+			if docs := model.backupDocs(bucket, name, t); count != docs {
+				t.Fatalf("Expected to backup %d items, got %d", docs, count)
+			}
+			model.verifyBackup(a, backupName, name, bucket, t)
+
+			// Restore every backup and check the purged backup left nothing behind
+			deleteBucket(host, bucket, t, true)
+			createCouchbaseBucket(host, bucket, "", t)
+
+			err = executeRestore(a, backupName, host, testCfg.Username, testCfg.Password, "",
+				"", 4, false, config)
+			checkError(err, t)
+
+			waitForItemCount(host, testCfg.Username, testCfg.Password, bucket,
+				model.restoredItems(bucket, "", "", t), t)
+			model.verifyRestore(host, bucket, "", "", t)
+			verifyBucketContents(host, bucket, expected, verifyOptions{}, t)
+		})
+	}
+}
@@ -8,12 +8,13 @@ import (
 )
 
 func TestGetPutViews(t *testing.T) {
-	bucket := "default"
-	defer deleteAllBuckets(testHost, t)
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, bucket, "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default", "copy")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("copy", t), "", t)
 
-	rest := couchbase.CreateRestClient(testHost, rbacUsername, rbacPassword, nil)
+	rest := couchbase.CreateRestClient(testCfg.Host, testCfg.Username, testCfg.Password, nil)
 	ddocs := make([]value.DDoc, 0)
 
 	single := make(map[string]map[string]map[string]string)
@@ -64,4 +65,121 @@ func TestGetPutViews(t *testing.T) {
 	if len(views) != 5 {
 		t.Fatal("Expected to get 5 views")
 	}
+
+	expected := designDocs{
+		"_design/single":     single,
+		"_design/multi":      multi,
+		"_design/red":        withreduce,
+		"_design/spatsingle": spatialsingle,
+		"_design/spatmulti":  spatialmulti,
+	}
+	verifyDesignDocs(testCfg.Host, bucket, expected, t)
+
+	// Putting the views we got back should recreate them exactly
+	checkError(rest.PutViews(env.bucket("copy", t), views), t)
+	verifyDesignDocs(testCfg.Host, env.bucket("copy", t), expected, t)
+}
+
+// Tests that development design documents round trip alongside production
+// design documents of the same name.
+func TestGetPutViewsDevMode(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "copy")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("copy", t), "", t)
+
+	rest := couchbase.CreateRestClient(testCfg.Host, testCfg.Username, testCfg.Password, nil)
+
+	expected := designDocs{
+		"_design/users": map[string]interface{}{
+			"views": map[string]interface{}{
+				"by_name": map[string]string{
+					"map": "function (doc, meta) {\n emit(doc.name, null);\n}",
+				},
+			},
+		},
+		"_design/dev_users": map[string]interface{}{
+			"views": map[string]interface{}{
+				"by_name": map[string]string{
+					"map":    "function (doc, meta) {\n emit(doc.name, doc.age);\n}",
+					"reduce": "_stats",
+				},
+				"by_age": map[string]string{
+					"map": "function (doc, meta) {\n emit(doc.age, null);\n}",
+				},
+			},
+		},
+	}
+	putDesignDocs(testCfg.Host, bucket, expected, t)
+	verifyDesignDocs(testCfg.Host, bucket, expected, t)
+
+	views, err := rest.GetViews(bucket)
+	checkError(err, t)
+
+	if len(views) != 2 {
+		t.Fatalf("Expected to get 2 views, got %d", len(views))
+	}
+
+	checkError(rest.PutViews(env.bucket("copy", t), views), t)
+	verifyDesignDocs(testCfg.Host, env.bucket("copy", t), expected, t)
+}
+
+// Tests that design document options are preserved.
+func TestGetPutViewsOptions(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "copy")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("copy", t), "", t)
+
+	rest := couchbase.CreateRestClient(testCfg.Host, testCfg.Username, testCfg.Password, nil)
+
+	expected := designDocs{
+		"_design/options": map[string]interface{}{
+			"views": map[string]interface{}{
+				"all": map[string]string{
+					"map":    "function (doc, meta) {\n emit(meta.id, null);\n}",
+					"reduce": "_count",
+				},
+			},
+			"options": map[string]interface{}{
+				"updateMinChanges":        100,
+				"replicaUpdateMinChanges": 50,
+				"updateInterval":          5000,
+			},
+		},
+	}
+	putDesignDocs(testCfg.Host, bucket, expected, t)
+	verifyDesignDocs(testCfg.Host, bucket, expected, t)
+
+	views, err := rest.GetViews(bucket)
+	checkError(err, t)
+
+	checkError(rest.PutViews(env.bucket("copy", t), views), t)
+	verifyDesignDocs(testCfg.Host, env.bucket("copy", t), expected, t)
+}
+
+// Tests a round trip of a large number of design documents with many views.
+func TestGetPutViewsLarge(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "copy")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("copy", t), "", t)
+
+	rest := couchbase.CreateRestClient(testCfg.Host, testCfg.Username, testCfg.Password, nil)
+
+	expected := loadViews(testCfg.Host, bucket, "large", 50, 20, t)
+	verifyDesignDocs(testCfg.Host, bucket, expected, t)
+
+	views, err := rest.GetViews(bucket)
+	checkError(err, t)
+
+	if len(views) != 50 {
+		t.Fatalf("Expected to get 50 views, got %d", len(views))
+	}
+
+	checkError(rest.PutViews(env.bucket("copy", t), views), t)
+	verifyDesignDocs(testCfg.Host, env.bucket("copy", t), expected, t)
 }
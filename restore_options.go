@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"github.com/couchbase/backup"
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/value"
+)
+
+// Replace TTL modes accepted by the restore.
+const (
+	replaceTTLNone    = "none"
+	replaceTTLAll     = "all"
+	replaceTTLExpired = "expired"
+)
+
+const defaultRestoreThreads = 4
+
+// restoreOptions names the arguments backup.ArchiveToCouchbaseTransferable
+// takes positionally. Zero values use the defaults.
+type restoreOptions struct {
+	// Range of backups to restore, empty means open ended
+	Start string
+	End   string
+
+	Threads int
+
+	// Only used for https hosts. The mock cluster and the clusters the tests
+	// are run against serve plain http, so no test sets them
+	CACert      string
+	NoSSLVerify bool
+
+	// Skip conflict resolution so that documents in the backup overwrite newer
+	// versions already in the cluster
+	ForceUpdates bool
+
+	// Maps the name of a bucket in the backup to the bucket to restore it to
+	BucketMap map[string]string
+
+	// One of the replace TTL modes, and the expiry to replace TTLs with
+	ReplaceTTL     string
+	ReplaceTTLWith int64
+
+	// Passed to the restore as they are, or nil to run without hooks. No test
+	// installs hooks, so this suite does not cover them
+	Hooks *backup.TransferHooks
+}
+
+// executeRestoreWithOptions restores the backups selected by opts. The
+// config controls which buckets and which parts of each bucket are restored.
+func executeRestoreWithOptions(a *archive.Archive, name, host, user, pwd string,
+	opts restoreOptions, config *value.BackupConfig) error {
+	if opts.Threads <= 0 {
+		opts.Threads = defaultRestoreThreads
+	}
+	if opts.BucketMap == nil {
+		opts.BucketMap = make(map[string]string)
+	}
+	if opts.ReplaceTTL == "" {
+		opts.ReplaceTTL = replaceTTLNone
+	}
+
+	t, err := backup.ArchiveToCouchbaseTransferable(a, name, host, user, pwd, opts.Start,
+		opts.End, opts.CACert, opts.Threads, opts.NoSSLVerify, opts.ForceUpdates, opts.BucketMap,
+		opts.ReplaceTTL, opts.ReplaceTTLWith, opts.Hooks, config)
+	for _, restore := range t {
+		err = restore.Execute()
+		if err != nil {
+			return err
+		}
+	}
+	return err
+}
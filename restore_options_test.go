@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that documents modified after the backup are only overwritten by the
+// restore when force updates is set.
+func TestRestoreForceUpdates(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "force-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "force", false, t)
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// Update every document so the cluster has newer revisions than the backup
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "force",
+		loadOptions{Mode: loadUpsert, DocSize: 64}, t)
+	modified := takeSnapshot(testCfg.Host, bucket, t)
+
+	// Conflict resolution should keep the newer documents in the cluster
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, restoreOptions{}, config)
+	checkError(err, t)
+
+	verifyBucketContents(testCfg.Host, bucket, modified, verifyOptions{CheckCas: true}, t)
+
+	// Forcing updates should overwrite them with the backed up documents
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, restoreOptions{ForceUpdates: true}, config)
+	checkError(err, t)
+
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
+
+// Tests restoring a bucket into a bucket with a different name leaves the
+// source bucket untouched.
+func TestRestoreBucketMap(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "mapped")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("mapped", t), "", t)
+
+	backupName := "bucket-map-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("default", t), 2000,
+		"map", false, t)
+	expected := takeSnapshot(testCfg.Host, env.bucket("default", t), t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucket("default", t)).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	opts := restoreOptions{
+		BucketMap: map[string]string{env.bucket("default", t): env.bucket("mapped", t)},
+	}
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("mapped", t),
+		2000, t)
+	verifyBucketContents(testCfg.Host, env.bucket("mapped", t), expected, verifyOptions{}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), expected,
+		verifyOptions{CheckCas: true}, t)
+}
+
+// Tests that the replace TTL modes rewrite the expiry of restored documents.
+func TestRestoreReplaceTTL(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "replace-ttl-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "ttl", false, t)
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// None of the documents have expired, so replacing expired TTLs is a no-op
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	opts := restoreOptions{ReplaceTTL: replaceTTLExpired, ReplaceTTLWith: expiry}
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+
+	// Replacing all TTLs gives every document the new expiry
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	opts.ReplaceTTL = replaceTTLAll
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	replaced := make(docSnapshot)
+	for key, doc := range expected {
+		doc.Expiry = uint32(expiry)
+		replaced[key] = doc
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
+	verifyBucketContents(testCfg.Host, bucket, replaced, verifyOptions{}, t)
+}
+
+// Tests that the restore config filters which of the backed up buckets are
+// restored.
+func TestRestoreIncludeBuckets(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default", "other")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
+	createCouchbaseBucket(testCfg.Host, env.bucket("other", t), "", t)
+
+	backupName := "restore-filter-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("default", t), 2000,
+		"filter", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("other", t), 1000,
+		"filter", false, t)
+	expected := takeSnapshot(testCfg.Host, env.bucket("default", t), t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	for _, name := range []string{"default", "other"} {
+		deleteBucket(testCfg.Host, env.bucket(name, t), t, true)
+		createCouchbaseBucket(testCfg.Host, env.bucket(name, t), "", t)
+	}
+
+	restoreConfig, err := newBackupConfig().WithIncludeBuckets(env.bucket("default", t)).Build()
+	checkError(err, t)
+
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, restoreOptions{}, restoreConfig)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, env.bucket("default", t),
+		2000, t)
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), expected, verifyOptions{}, t)
+	verifyBucketContents(testCfg.Host, env.bucket("other", t), docSnapshot{}, verifyOptions{}, t)
+}
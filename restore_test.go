@@ -3,102 +3,83 @@ package tests
 import (
 	"strconv"
 	"testing"
-	"time"
 
 	"github.com/couchbase/backup/archive"
-	"github.com/couchbase/backup/value"
 )
 
 func TestBackupRestore(t *testing.T) {
-	defer cleanup()
-	defer deleteAllBuckets(testHost, t)
-	cleanup()
-	deleteAllBuckets(testHost, t)
-	createCouchbaseBucket(testHost, "default", "", t)
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
 	backupName := "restore-test"
 
-	loadData(testHost, rbacUsername, rbacPassword, "default", 5000, "full", false, t)
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, "full", false, t)
 
-	config := value.CreateBackupConfig("", "", make([]string, 0),
-		make([]string, 0), make([]string, 0), make([]string, 0),
-		false, false, false, false, false, false, false, false, []int{})
+	config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+	checkError(err, t)
 
-	a, err := archive.MountArchive(testDir, true)
+	a, err := archive.MountArchive(env.archive, true)
 	checkError(err, t)
 
 	checkError(a.CreateRepo(backupName, config), t)
 
+	expected := takeSnapshot(testCfg.Host, env.bucket("default", t), t)
+
 	// Test that restoring data when none exists gives an error
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "name",
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "name",
 		"name", 4, false, config)
-	if err == nil {
-		t.Fatal(err.Error())
-	} else if _, ok := err.(archive.EmptyRangeError); !ok {
-		t.Fatal(err.Error())
-	}
+	requireEmptyRange(err, t)
 
 	// Backup the data
-	name, err := executeBackup(a, backupName, "archive", testHost, rbacUsername, rbacPassword,
-		4, false, false)
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host,
+		testCfg.Username, testCfg.Password, 4, false, false)
 	checkError(err, t)
 
 	info, err := a.BackupInfo(backupName, name)
 	checkError(err, t)
 
-	count := info["default"].NumDocs
+	count := info[env.bucket("default", t)].NumDocs
 	if count != 5000 {
 		t.Fatal("Expected to backup 5000 items, got " + strconv.Itoa(count))
 	}
 
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	// The backup should hold the documents exactly as they were in the cluster
+	verifyBackupContents(a, backupName, name, env.bucket("default", t), expected,
+		verifyOptions{CheckCas: true, CheckRevision: true}, t)
+
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
 	// Check that using an invalid start point causes an error
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "name",
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "name",
 		name, 4, false, config)
-	if err == nil {
-		t.Fatal(err.Error())
-	} else if _, ok := err.(archive.RangePointError); !ok {
-		t.Fatal(err.Error())
-	}
+	requireRangePoint(err, t)
 
 	// Check that using an invalid end point causes an error
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, name,
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, name,
 		"end", 4, false, config)
-	if err == nil {
-		t.Fatal(err.Error())
-	} else if _, ok := err.(archive.RangePointError); !ok {
-		t.Fatal(err.Error())
-	}
+	requireRangePoint(err, t)
 
 	// Restore the data using explicit start/end specification
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, name,
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, name,
 		name, 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err := getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	if err != nil {
-		t.Fatalf("Error getting item count: %s", err.Error())
-	}
-	if items != 5000 {
-		t.Fatalf("Expected 5000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, t)
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), expected, verifyOptions{}, t)
 
-	deleteBucket(testHost, "default", t, true)
-	createCouchbaseBucket(testHost, "default", "", t)
+	deleteBucket(testCfg.Host, env.bucket("default", t), t, true)
+	createCouchbaseBucket(testCfg.Host, env.bucket("default", t), "", t)
 
 	// Restore the data without explicitly setting the start/end point
-	err = executeRestore(a, backupName, testHost, rbacUsername, rbacPassword, "",
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
 		"", 4, false, config)
 	checkError(err, t)
 
-	time.Sleep(5 * time.Second)
-	items, err = getNumItems(testHost, rbacUsername, rbacPassword, "default")
-	checkError(err, t)
-
-	if items != 5000 {
-		t.Fatalf("Expected 5000 items, got %d", items)
-	}
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+		env.bucket("default", t), 5000, t)
+	verifyBucketContents(testCfg.Host, env.bucket("default", t), expected, verifyOptions{}, t)
 }
@@ -0,0 +1,97 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that a backup interrupted part way through can be resumed and that
+// the resumed backup contains every document exactly once. Each case runs
+// against its own mock cluster so that the injected faults only affect the
+// backup under test.
+func TestBackupResume(t *testing.T) {
+	cases := []struct {
+		name   string
+		inject func(mc *mockCluster, bucket string)
+	}{
+		{"AfterItems", func(mc *mockCluster, bucket string) {
+			mc.dropDcpAfter(2500)
+		}},
+		{"AtVBucket", func(mc *mockCluster, bucket string) {
+			mc.dropDcpAtVBucket(uint16(mockNumVBuckets / 2))
+		}},
+		// The design documents are read while the bucket's metadata is backed
+		// up, after the backup has been created in the repository
+		{"MetadataPhase", func(mc *mockCluster, bucket string) {
+			mc.failRequests("/pools/default/buckets/" + bucket + "/ddocs")
+		}},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			mc := newMockCluster(testCfg.Username, testCfg.Password)
+			t.Cleanup(mc.Close)
+
+			host, bucket, backupName := mc.URL(), "default", "resume-test"
+			createCouchbaseBucket(host, bucket, "", t)
+
+			model := newShadowModel()
+			model.loadData(host, testCfg.Username, testCfg.Password, bucket, 5000, "resume",
+				false, t)
+			loadViews(host, bucket, "resume", 2, 1, t)
+			expected := takeSnapshot(host, bucket, t)
+
+			config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+			checkError(err, t)
+
+			a, err := archive.MountArchive(t.TempDir(), true)
+			checkError(err, t)
+
+			checkError(a.CreateRepo(backupName, config), t)
+
+			c.inject(mc, bucket)
+			interrupted := abandonBackup(mc, a, backupName, t)
+
+			name, err := executeBackup(a, backupName, "archive", host, testCfg.Username,
+				testCfg.Password, 4, true, false)
+			checkError(err, t)
+			model.backup(name)
+
+			if name != interrupted {
+				t.Fatalf("Expected to resume backup %s, but got %s", interrupted, name)
+			}
+
+			info, err := a.BackupInfo(backupName, name)
+			checkError(err, t)
+
+			count := info[bucket].NumDocs
+			if docs := model.backupDocs(bucket, name, t); count != docs {
+				t.Fatalf("Expected to backup %d items, got %d", docs, count)
+			}
+			model.verifyBackup(a, backupName, name, bucket, t)
+
+			rinfo, err := a.RepoInfo(backupName)
+			checkError(err, t)
+			if rinfo.NumBackups != 1 {
+				t.Fatalf("Expected 1 backup after resume, got %d", rinfo.NumBackups)
+			}
+
+			// Restore the resumed backup and check nothing was lost or duplicated
+			deleteBucket(host, bucket, t, true)
+			createCouchbaseBucket(host, bucket, "", t)
+
+			err = executeRestore(a, backupName, host, testCfg.Username, testCfg.Password, "",
+				"", 4, false, config)
+			checkError(err, t)
+
+			waitForItemCount(host, testCfg.Username, testCfg.Password, bucket,
+				model.restoredItems(bucket, "", "", t), t)
+			model.verifyRestore(host, bucket, "", "", t)
+			waitForViewsPresent(host, bucket, 2, t)
+			verifyBucketContents(host, bucket, expected, verifyOptions{}, t)
+		})
+	}
+}
@@ -0,0 +1,353 @@
+package tests
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/couchbase"
+	"github.com/couchbase/backup/storage"
+)
+
+// scenario is a declarative backup/restore test case. Scenarios are stored as
+// JSON files under testdata/scenarios and run as subtests by TestScenarios.
+//
+// Backups are referred to by the alias given in the "name" field of a backup
+// step, restores and merges use these aliases for their start and end points.
+// An empty start or end means an open ended range.
+type scenario struct {
+	Name    string           `json:"name"`
+	Buckets []scenarioBucket `json:"buckets"`
+	Config  scenarioConfig   `json:"config"`
+	Steps   []scenarioStep   `json:"steps"`
+}
+
+type scenarioBucket struct {
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	Password string `json:"password"`
+}
+
+type scenarioConfig struct {
+	IncludeBuckets      []string `json:"include_buckets"`
+	ExcludeBuckets      []string `json:"exclude_buckets"`
+	DisableBucketConfig bool     `json:"disable_bucket_config"`
+	DisableViews        bool     `json:"disable_views"`
+	DisableGSI          bool     `json:"disable_gsi"`
+	DisableFTS          bool     `json:"disable_fts"`
+	DisableData         bool     `json:"disable_data"`
+}
+
+type scenarioStep struct {
+	Action string `json:"action"`
+
+	// Used by the load, delete, views and recreate_bucket actions
+	Bucket string `json:"bucket"`
+	Items  int    `json:"items"`
+	Prefix string `json:"prefix"`
+	DDocs  int    `json:"ddocs"`
+	Views  int    `json:"views"`
+
+	// Used by the backup, merge and restore actions
+	Name  string `json:"name"`
+	Start string `json:"start"`
+	End   string `json:"end"`
+
+	// Expected backed up document counts, keyed by bucket
+	ExpectDocs map[string]int `json:"expect_docs"`
+	// Expected bucket item counts after a restore, keyed by bucket
+	ExpectItems map[string]uint64 `json:"expect_items"`
+	// Expected number of backups in the repository after a merge
+	ExpectBackups int `json:"expect_backups"`
+	// Name of the error type the step is expected to fail with
+	ExpectError string `json:"expect_error"`
+
+	// Config a restore uses in place of the scenario config, if set
+	Config *scenarioConfig `json:"config"`
+}
+
+func loadScenario(path string) (*scenario, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var s scenario
+	decoder := json.NewDecoder(file)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&s); err != nil {
+		return nil, fmt.Errorf("Unable to parse scenario %s: %s", path, err.Error())
+	}
+
+	if s.Name == "" {
+		return nil, fmt.Errorf("Scenario %s has no name", path)
+	}
+
+	return &s, nil
+}
+
+// scenarioRun holds the state of a scenario while it executes.
+type scenarioRun struct {
+	t       *testing.T
+	s       *scenario
+	env     *testEnv
+	a       *archive.Archive
+	repo    string
+	backups map[string]string
+}
+
+func runScenario(t *testing.T, s *scenario) {
+	names := make([]string, 0, len(s.Buckets))
+	for _, b := range s.Buckets {
+		names = append(names, b.Name)
+	}
+
+	run := &scenarioRun{
+		t:       t,
+		s:       s,
+		env:     newTestEnv(t, names...),
+		repo:    "scenario",
+		backups: make(map[string]string),
+	}
+
+	for _, b := range s.Buckets {
+		run.createBucket(b)
+	}
+
+	config, err := run.backupConfig(s.Config).Build()
+	checkError(err, t)
+
+	run.a, err = archive.MountArchive(run.env.archive, true)
+	checkError(err, t)
+
+	checkError(run.a.CreateRepo(run.repo, config), t)
+
+	for i, step := range s.Steps {
+		if err := run.step(step); err != nil {
+			t.Fatalf("Step %d (%s) failed: %s", i, step.Action, err.Error())
+		}
+	}
+}
+
+func (r *scenarioRun) backupConfig(c scenarioConfig) *backupConfigBuilder {
+	builder := newBackupConfig()
+
+	if len(c.ExcludeBuckets) > 0 {
+		for _, name := range c.ExcludeBuckets {
+			builder.WithExcludeBuckets(r.env.bucket(name, r.t))
+		}
+	} else if len(c.IncludeBuckets) > 0 {
+		for _, name := range c.IncludeBuckets {
+			builder.WithIncludeBuckets(r.env.bucket(name, r.t))
+		}
+	} else {
+		builder.WithIncludeBuckets(r.env.bucketNames()...)
+	}
+
+	if c.DisableBucketConfig {
+		builder.DisableBucketConfig()
+	}
+	if c.DisableViews {
+		builder.DisableViews()
+	}
+	if c.DisableGSI {
+		builder.DisableGSI()
+	}
+	if c.DisableFTS {
+		builder.DisableFTS()
+	}
+	if c.DisableData {
+		builder.DisableData()
+	}
+
+	return builder
+}
+
+func (r *scenarioRun) createBucket(b scenarioBucket) {
+	switch b.Type {
+	case "", "couchbase":
+		createCouchbaseBucket(testCfg.Host, r.env.bucket(b.Name, r.t), b.Password, r.t)
+	case "memcached":
+		createMemcachedBucket(testCfg.Host, r.env.bucket(b.Name, r.t), b.Password, r.t)
+	default:
+		r.t.Fatalf("Unknown bucket type `%s`", b.Type)
+	}
+}
+
+func (r *scenarioRun) declaredBucket(name string) scenarioBucket {
+	for _, b := range r.s.Buckets {
+		if b.Name == name {
+			return b
+		}
+	}
+	r.t.Fatalf("Bucket `%s` is not declared by the scenario", name)
+	return scenarioBucket{}
+}
+
+// alias resolves a backup alias to the name of the backup in the repository.
+// Names that aren't aliases are passed through unchanged so that scenarios can
+// exercise invalid range points.
+func (r *scenarioRun) alias(name string) string {
+	if backup, ok := r.backups[name]; ok {
+		return backup
+	}
+	return name
+}
+
+func (r *scenarioRun) step(step scenarioStep) error {
+	switch step.Action {
+	case "load", "delete":
+		loadData(testCfg.Host, testCfg.Username, testCfg.Password, r.env.bucket(step.Bucket, r.t),
+			step.Items, step.Prefix, step.Action == "delete", r.t)
+	case "views":
+		loadViews(testCfg.Host, r.env.bucket(step.Bucket, r.t), step.Prefix, step.DDocs, step.Views,
+			r.t)
+	case "delete_bucket":
+		deleteBucket(testCfg.Host, r.env.bucket(step.Bucket, r.t), r.t, true)
+	case "recreate_bucket":
+		deleteBucket(testCfg.Host, r.env.bucket(step.Bucket, r.t), r.t, true)
+		r.createBucket(r.declaredBucket(step.Bucket))
+	case "backup":
+		return r.backup(step)
+	case "merge":
+		return r.merge(step)
+	case "restore":
+		return r.restore(step)
+	default:
+		return fmt.Errorf("Unknown action `%s`", step.Action)
+	}
+
+	return nil
+}
+
+func (r *scenarioRun) backup(step scenarioStep) error {
+	name, err := executeBackup(r.a, r.repo, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	if done, err := checkScenarioError(step, err); done {
+		return err
+	}
+
+	if step.Name != "" {
+		r.backups[step.Name] = name
+	}
+
+	return r.checkDocs(step, name)
+}
+
+func (r *scenarioRun) merge(step scenarioStep) error {
+	start, end := r.alias(step.Start), r.alias(step.End)
+
+	_, err := r.a.MergeIncrBackups(r.repo, start, end, storage.DefaultStorageConfig())
+	if done, err := checkScenarioError(step, err); done {
+		return err
+	}
+
+	if step.Name != "" {
+		r.backups[step.Name] = end
+	}
+
+	if step.ExpectBackups > 0 {
+		info, err := r.a.RepoInfo(r.repo)
+		if err != nil {
+			return err
+		}
+
+		if info.NumBackups != step.ExpectBackups {
+			return fmt.Errorf("Expected %d backups after merge, got %d", step.ExpectBackups,
+				info.NumBackups)
+		}
+	}
+
+	return r.checkDocs(step, end)
+}
+
+func (r *scenarioRun) restore(step scenarioStep) error {
+	start, end := r.alias(step.Start), r.alias(step.End)
+
+	c := r.s.Config
+	if step.Config != nil {
+		c = *step.Config
+	}
+
+	config, err := r.backupConfig(c).Build()
+	if err != nil {
+		return err
+	}
+
+	err = executeRestore(r.a, r.repo, testCfg.Host, testCfg.Username, testCfg.Password,
+		start, end, 4, false, config)
+	if done, err := checkScenarioError(step, err); done {
+		return err
+	}
+
+	if len(step.ExpectItems) == 0 {
+		return nil
+	}
+
+	for bucket, expected := range step.ExpectItems {
+		waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password,
+			r.env.bucket(bucket, r.t), expected, r.t)
+	}
+
+	return nil
+}
+
+func (r *scenarioRun) checkDocs(step scenarioStep, name string) error {
+	if len(step.ExpectDocs) == 0 {
+		return nil
+	}
+
+	info, err := r.a.BackupInfo(r.repo, name)
+	if err != nil {
+		return err
+	}
+
+	for bucket, expected := range step.ExpectDocs {
+		count := info[r.env.bucket(bucket, r.t)].NumDocs
+		if count != expected {
+			return fmt.Errorf("Expected to backup %d items from %s, got %d", expected, bucket,
+				count)
+		}
+	}
+
+	return nil
+}
+
+// checkScenarioError compares the error returned by a step against the error
+// the step expects. It returns true if the step should not continue, along
+// with the error to report, if any.
+func checkScenarioError(step scenarioStep, err error) (bool, error) {
+	if step.ExpectError == "" {
+		return err != nil, err
+	}
+
+	if err == nil {
+		return true, fmt.Errorf("Expected %s, but the step succeeded", step.ExpectError)
+	}
+
+	var matches bool
+	switch step.ExpectError {
+	case "any":
+		matches = true
+	case "EmptyRangeError":
+		matches = errors.As(err, new(archive.EmptyRangeError))
+	case "RangePointError":
+		matches = errors.As(err, new(archive.RangePointError))
+	case "BucketNotFoundError":
+		matches = errors.As(err, new(couchbase.BucketNotFoundError))
+	case "HttpError":
+		matches = errors.As(err, new(couchbase.HttpError))
+	default:
+		return true, fmt.Errorf("Unknown expected error `%s`", step.ExpectError)
+	}
+
+	if !matches {
+		return true, fmt.Errorf("Expected %s, got %T: %s", step.ExpectError, err, err.Error())
+	}
+
+	return true, nil
+}
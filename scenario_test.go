@@ -0,0 +1,22 @@
+package tests
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestScenarios runs every scenario file in testdata/scenarios as a subtest.
+func TestScenarios(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join("testdata", "scenarios", "*.json"))
+	checkError(err, t)
+
+	for _, file := range files {
+		s, err := loadScenario(file)
+		checkError(err, t)
+
+		t.Run(s.Name, func(t *testing.T) {
+			t.Parallel()
+			runScenario(t, s)
+		})
+	}
+}
@@ -0,0 +1,358 @@
+package tests
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+// shadowDoc is the state of a single key as seen by the shadow model.
+type shadowDoc struct {
+	Deleted bool
+	Expiry  time.Time
+	// How long before Expiry the document may expire. TTLs are turned into
+	// expiry times by the data service as each document is written, so a
+	// document loaded with a TTL expires somewhere in the window the load ran.
+	ExpirySlack time.Duration
+}
+
+func (d shadowDoc) live(now time.Time) bool {
+	return !d.Deleted && (d.Expiry.IsZero() || d.Expiry.After(now))
+}
+
+// shadowBackup is the set of changes the model expects a backup to contain,
+// keyed by bucket and then by document key.
+type shadowBackup struct {
+	name    string
+	changes map[string]map[string]shadowDoc
+}
+
+// shadowModel is an in-memory model of the keys the tests write to the
+// cluster. It records every mutation made through it and snapshots the
+// changes at each backup, so that tests can ask which keys a backup or a
+// restore of a range of backups should contain instead of working the counts
+// out by hand.
+type shadowModel struct {
+	mutex sync.Mutex
+	// The current state of every key written to each bucket
+	live map[string]map[string]shadowDoc
+	// Changes made to each bucket since the last backup
+	pending map[string]map[string]shadowDoc
+	// Buckets whose next backup will be a full backup
+	rollback map[string]bool
+	backups  []shadowBackup
+}
+
+func newShadowModel() *shadowModel {
+	return &shadowModel{
+		live:     make(map[string]map[string]shadowDoc),
+		pending:  make(map[string]map[string]shadowDoc),
+		rollback: make(map[string]bool),
+		backups:  make([]shadowBackup, 0),
+	}
+}
+
+// record notes a change to a single key. A zero expiry means the document
+// never expires.
+func (m *shadowModel) record(bucket, key string, deleted bool, expiry time.Time) {
+	m.recordDoc(bucket, key, shadowDoc{Deleted: deleted, Expiry: expiry})
+}
+
+func (m *shadowModel) recordDoc(bucket, key string, doc shadowDoc) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if m.live[bucket] == nil {
+		m.live[bucket] = make(map[string]shadowDoc)
+	}
+	if m.pending[bucket] == nil {
+		m.pending[bucket] = make(map[string]shadowDoc)
+	}
+
+	m.live[bucket][key] = doc
+	m.pending[bucket][key] = doc
+}
+
+// loadData calls loadData and records the keys it wrote, or deleted.
+func (m *shadowModel) loadData(host, username, password, bucket string, items int,
+	prefix string, delete bool, t *testing.T) {
+	loadData(host, username, password, bucket, items, prefix, delete, t)
+
+	for i := 0; i < items; i++ {
+		m.record(bucket, prefix+strconv.Itoa(i), delete, time.Time{})
+	}
+}
+
+// bulkLoad calls bulkLoad and records the keys it wrote, or removed, along
+// with the expiry each document was given.
+func (m *shadowModel) bulkLoad(host, username, password, bucket string, items int,
+	prefix string, opts loadOptions, t *testing.T) loadStats {
+	stats := bulkLoad(host, username, password, bucket, items, prefix, opts, t)
+	loaded := time.Now()
+
+	for i := 0; i < items; i++ {
+		doc := shadowDoc{Deleted: opts.Mode == loadRemove}
+		if opts.Expiry != nil && !doc.Deleted {
+			doc.Expiry, doc.ExpirySlack = loadedExpiry(opts.Expiry(i), loaded, stats.Duration)
+		}
+		m.recordDoc(bucket, prefix+strconv.Itoa(i), doc)
+	}
+
+	return stats
+}
+
+// loadedExpiry returns the time a document loaded with the expiry will expire
+// for a load which finished at loaded after running for duration, and how much
+// earlier than that it may expire.
+func loadedExpiry(expiry uint32, loaded time.Time, duration time.Duration) (time.Time,
+	time.Duration) {
+	ttl := time.Duration(expiry) * time.Second
+	if expiry == 0 {
+		return time.Time{}, 0
+	} else if ttl > maxRelativeTTL {
+		return time.Unix(int64(expiry), 0), 0
+	}
+	return loaded.Add(ttl), duration
+}
+
+// purgeTombstones records that the deletions in a bucket have been purged.
+// The next backup of the bucket will roll back to zero and so contain every
+// live document, but no deletions.
+func (m *shadowModel) purgeTombstones(bucket string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	for key, doc := range m.live[bucket] {
+		if doc.Deleted {
+			delete(m.live[bucket], key)
+		}
+	}
+	m.rollback[bucket] = true
+}
+
+// dropBucket records that a bucket has been deleted from the cluster.
+func (m *shadowModel) dropBucket(bucket string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	delete(m.live, bucket)
+	delete(m.pending, bucket)
+	m.rollback[bucket] = true
+}
+
+// backup snapshots the changes made since the previous backup. It should be
+// called with the name of each successful backup.
+func (m *shadowModel) backup(name string) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	changes := make(map[string]map[string]shadowDoc)
+	for bucket, pending := range m.pending {
+		changes[bucket] = pending
+	}
+
+	for bucket := range m.rollback {
+		full := make(map[string]shadowDoc)
+		for key, doc := range m.live[bucket] {
+			if !doc.Deleted {
+				full[key] = doc
+			}
+		}
+		changes[bucket] = full
+	}
+
+	m.backups = append(m.backups, shadowBackup{name: name, changes: changes})
+	m.pending = make(map[string]map[string]shadowDoc)
+	m.rollback = make(map[string]bool)
+}
+
+// merge replaces the backups from start to end with a single backup named end
+// containing the latest change to every key.
+func (m *shadowModel) merge(start, end string, t *testing.T) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	first, last := m.backupRange(start, end, t)
+	merged := shadowBackup{name: m.backups[last].name, changes: m.combine(first, last)}
+
+	backups := append(make([]shadowBackup, 0, len(m.backups)), m.backups[:first]...)
+	backups = append(backups, merged)
+	m.backups = append(backups, m.backups[last+1:]...)
+}
+
+// backupDocs returns the number of documents, including deletions, the model
+// expects the named backup to contain for a bucket.
+func (m *shadowModel) backupDocs(bucket, name string, t *testing.T) int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	first, _ := m.backupRange(name, name, t)
+	return len(m.backups[first].changes[bucket])
+}
+
+// backupContents returns the documents the model expects the named backup to
+// hold live for a bucket, leaving out deletions.
+func (m *shadowModel) backupContents(bucket, name string, t *testing.T) map[string]shadowDoc {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	first, _ := m.backupRange(name, name, t)
+
+	docs := make(map[string]shadowDoc)
+	for key, doc := range m.backups[first].changes[bucket] {
+		if !doc.Deleted {
+			docs[key] = doc
+		}
+	}
+	return docs
+}
+
+// restoredDocs returns the documents a restore of the backups from start to
+// end should write to an empty bucket. An empty start or end means an open
+// ended range, as with executeRestore.
+func (m *shadowModel) restoredDocs(bucket, start, end string,
+	t *testing.T) map[string]shadowDoc {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	first, last := m.backupRange(start, end, t)
+	now := time.Now()
+
+	docs := make(map[string]shadowDoc)
+	for key, doc := range m.combine(first, last)[bucket] {
+		if doc.live(now) {
+			docs[key] = doc
+		}
+	}
+	return docs
+}
+
+// restoredKeys returns the sorted keys a restore of the backups from start to
+// end should write to an empty bucket.
+func (m *shadowModel) restoredKeys(bucket, start, end string, t *testing.T) []string {
+	docs := m.restoredDocs(bucket, start, end, t)
+
+	keys := make([]string, 0, len(docs))
+	for key := range docs {
+		keys = append(keys, key)
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+// restoredItems returns the number of items a bucket should contain after a
+// restore of the backups from start to end into an empty bucket.
+func (m *shadowModel) restoredItems(bucket, start, end string, t *testing.T) uint64 {
+	return uint64(len(m.restoredKeys(bucket, start, end, t)))
+}
+
+// verifyRestore fails the test if the bucket does not hold exactly the keys a
+// restore of the backups from start to end should write, each with the expiry
+// it was given.
+func (m *shadowModel) verifyRestore(host, bucket, start, end string, t *testing.T) {
+	t.Helper()
+
+	actual, err := snapshotBucket(host, testCfg.Username, testCfg.Password, bucket)
+	if err != nil {
+		t.Fatalf("Unable to read the contents of bucket %s: %s", bucket, err.Error())
+	}
+
+	diff := compareShadow(m.restoredDocs(bucket, start, end, t), actual)
+	if !diff.Empty() {
+		t.Fatalf("Restore of `%s` to `%s` into bucket %s does not match the shadow model: %s",
+			start, end, bucket, diff.String())
+	}
+}
+
+// compareShadow diffs the documents the model expects against a snapshot. The
+// model doesn't know document bodies so only keys and expiries are compared.
+// Expiries may be a second out either way as they are stored in whole seconds.
+func compareShadow(expected map[string]shadowDoc, actual docSnapshot) *docDiff {
+	diff := &docDiff{
+		Missing:    make([]string, 0),
+		Extra:      make([]string, 0),
+		Mismatched: make([]docMismatch, 0),
+	}
+
+	for key, exp := range expected {
+		act, ok := actual[key]
+		if !ok {
+			diff.Missing = append(diff.Missing, key)
+			continue
+		}
+
+		if exp.Expiry.IsZero() {
+			if act.Expiry != 0 {
+				diff.Mismatched = append(diff.Mismatched, docMismatch{key, "expiry", "0",
+					strconv.FormatUint(uint64(act.Expiry), 10)})
+			}
+			continue
+		}
+
+		earliest := exp.Expiry.Add(-exp.ExpirySlack).Unix() - 1
+		latest := exp.Expiry.Unix() + 1
+		if int64(act.Expiry) < earliest || int64(act.Expiry) > latest {
+			diff.Mismatched = append(diff.Mismatched, docMismatch{key, "expiry",
+				fmt.Sprintf("%d to %d", earliest, latest),
+				strconv.FormatUint(uint64(act.Expiry), 10)})
+		}
+	}
+
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			diff.Extra = append(diff.Extra, key)
+		}
+	}
+
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Extra)
+	sort.Slice(diff.Mismatched, func(i, j int) bool {
+		return diff.Mismatched[i].Key < diff.Mismatched[j].Key
+	})
+
+	return diff
+}
+
+func (m *shadowModel) combine(first, last int) map[string]map[string]shadowDoc {
+	combined := make(map[string]map[string]shadowDoc)
+	for _, b := range m.backups[first : last+1] {
+		for bucket, changes := range b.changes {
+			if combined[bucket] == nil {
+				combined[bucket] = make(map[string]shadowDoc)
+			}
+			for key, doc := range changes {
+				combined[bucket][key] = doc
+			}
+		}
+	}
+	return combined
+}
+
+func (m *shadowModel) backupRange(start, end string, t *testing.T) (int, int) {
+	if len(m.backups) == 0 {
+		t.Fatal("The shadow model has not recorded any backups")
+	}
+
+	first, last := 0, len(m.backups)-1
+	for i, b := range m.backups {
+		if b.name == start {
+			first = i
+		}
+		if b.name == end {
+			last = i
+		}
+	}
+
+	if (start != "" && m.backups[first].name != start) ||
+		(end != "" && m.backups[last].name != end) {
+		t.Fatalf("The shadow model has no backups named `%s` and `%s`", start, end)
+	} else if first > last {
+		t.Fatalf("Backup `%s` was taken after `%s`", start, end)
+	}
+
+	return first, last
+}
@@ -0,0 +1,116 @@
+package tests
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestShadowModel(t *testing.T) {
+	model := newShadowModel()
+
+	write := func(items int, prefix string, deleted bool) {
+		for i := 0; i < items; i++ {
+			model.record("default", prefix+strconv.Itoa(i), deleted, time.Time{})
+		}
+	}
+
+	write(5000, "full", false)
+	model.backup("one")
+	write(4000, "incr-1-", false)
+	model.backup("two")
+	write(3000, "incr-2-", false)
+	write(1000, "full", true)
+	model.backup("three")
+
+	if docs := model.backupDocs("default", "three", t); docs != 4000 {
+		t.Fatalf("Expected backup three to contain 4000 documents, got %d", docs)
+	}
+
+	expected := []struct {
+		start, end string
+		items      uint64
+	}{
+		{"", "", 11000},
+		{"two", "three", 7000},
+		{"", "two", 9000},
+		{"three", "", 3000},
+	}
+
+	for _, e := range expected {
+		if items := model.restoredItems("default", e.start, e.end, t); items != e.items {
+			t.Fatalf("Expected restore of `%s` to `%s` to contain %d items, got %d", e.start,
+				e.end, e.items, items)
+		}
+	}
+
+	// Documents which have expired by the time of the restore are not restored
+	model.record("default", "ttl", false, time.Now().Add(-time.Second))
+	model.backup("four")
+	if items := model.restoredItems("default", "four", "four", t); items != 0 {
+		t.Fatalf("Expected expired document not to be restored, got %d items", items)
+	}
+
+	// After tombstones are purged the next backup contains every live document
+	model.purgeTombstones("default")
+	write(500, "final", false)
+	model.backup("five")
+	if docs := model.backupDocs("default", "five", t); docs != 11501 {
+		t.Fatalf("Expected backup five to contain 11501 documents, got %d", docs)
+	}
+
+	model.merge("one", "five", t)
+	if docs := model.backupDocs("default", "five", t); docs != 12501 {
+		t.Fatalf("Expected merged backup to contain 12501 documents, got %d", docs)
+	}
+	if items := model.restoredItems("default", "", "", t); items != 11500 {
+		t.Fatalf("Expected restore of merged backup to contain 11500 items, got %d", items)
+	}
+}
+
+func TestCompareShadow(t *testing.T) {
+	loaded := time.Unix(1700000000, 0)
+	expires, slack := loadedExpiry(3600, loaded, 10*time.Second)
+	if !expires.Equal(loaded.Add(time.Hour)) || slack != 10*time.Second {
+		t.Fatalf("Expected TTL to expire an hour after the load, got %s less %s", expires, slack)
+	}
+
+	long := uint32(loaded.Add(60 * 24 * time.Hour).Unix())
+	if expires, slack := loadedExpiry(long, loaded, time.Second); expires.Unix() != int64(long) ||
+		slack != 0 {
+		t.Fatalf("Expected long TTL to be taken as an absolute time, got %s", expires)
+	}
+
+	expected := map[string]shadowDoc{
+		"forever": {},
+		"ttl":     {Expiry: expires, ExpirySlack: slack},
+		"missing": {},
+	}
+
+	// Documents written at the start of the load expire up to the slack early
+	actual := docSnapshot{
+		"forever": {Key: "forever"},
+		"ttl":     {Key: "ttl", Expiry: uint32(expires.Add(-slack).Unix())},
+		"extra":   {Key: "extra"},
+	}
+
+	diff := compareShadow(expected, actual)
+	if len(diff.Missing) != 1 || diff.Missing[0] != "missing" {
+		t.Fatalf("Expected `missing` to be missing, got %v", diff.Missing)
+	}
+	if len(diff.Extra) != 1 || diff.Extra[0] != "extra" {
+		t.Fatalf("Expected `extra` to be extra, got %v", diff.Extra)
+	}
+	if len(diff.Mismatched) != 0 {
+		t.Fatalf("Expected expiries to match, got %s", diff.String())
+	}
+
+	actual["forever"] = docMeta{Key: "forever", Expiry: uint32(expires.Unix())}
+	actual["ttl"] = docMeta{Key: "ttl", Expiry: uint32(expires.Add(5 * time.Second).Unix())}
+
+	diff = compareShadow(expected, actual)
+	if len(diff.Mismatched) != 2 || diff.Mismatched[0].Key != "forever" ||
+		diff.Mismatched[1].Key != "ttl" {
+		t.Fatalf("Expected expiry of `forever` and `ttl` to mismatch, got %s", diff.String())
+	}
+}
@@ -0,0 +1,230 @@
+package tests
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// docMeta is a single document along with the metadata that backup and
+// restore are expected to preserve.
+type docMeta struct {
+	Key      string
+	Value    []byte
+	Flags    uint32
+	Expiry   uint32
+	Datatype uint8
+	Cas      uint64
+	RevSeqno uint64
+}
+
+// docSnapshot is the set of live documents in a bucket keyed by document key.
+type docSnapshot map[string]docMeta
+
+// snapshotBucket reads every live document in a bucket by streaming each
+// vbucket over DCP from the node that owns it. The bucket should be quiesced
+// while the snapshot is taken.
+func snapshotBucket(host, username, password, bucket string) (docSnapshot, error) {
+	servers, vbmap, err := bucketVBucketMap(host, username, password, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	owned := make(map[int][]uint16)
+	for vb, chain := range vbmap {
+		if len(chain) == 0 || chain[0] < 0 {
+			return nil, fmt.Errorf("VBucket %d of %s has no active copy", vb, bucket)
+		}
+		owned[chain[0]] = append(owned[chain[0]], uint16(vb))
+	}
+
+	snapshot := make(docSnapshot)
+	for server, vbuckets := range owned {
+		err := streamVBuckets(servers[server], username, password, bucket, vbuckets, snapshot)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+func bucketVBucketMap(host, username, password, bucket string) ([]string, [][]int, error) {
+	req, err := http.NewRequest("GET", host+"/pools/default/b/"+bucket, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	req.SetBasicAuth(username, password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, nil, fmt.Errorf("Getting bucket config for %s returned %d", bucket,
+			resp.StatusCode)
+	}
+
+	type overlay struct {
+		VBucketServerMap struct {
+			ServerList []string `json:"serverList"`
+			VBucketMap [][]int  `json:"vBucketMap"`
+		} `json:"vBucketServerMap"`
+	}
+
+	var data overlay
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, nil, err
+	}
+
+	return data.VBucketServerMap.ServerList, data.VBucketServerMap.VBucketMap, nil
+}
+
+// dcpConn is a minimal DCP consumer used to read the contents of a bucket.
+type dcpConn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	opaque uint32
+}
+
+func (c *dcpConn) request(req *mcPacket) (*mcPacket, error) {
+	c.opaque++
+	req.magic = mcReqMagic
+	req.opaque = c.opaque
+
+	if _, err := c.conn.Write(req.bytes()); err != nil {
+		return nil, err
+	}
+
+	resp, err := readPacket(c.reader)
+	if err != nil {
+		return nil, err
+	} else if resp.vbucket != mcStatusSuccess {
+		return resp, fmt.Errorf("Opcode 0x%02x failed with status 0x%02x: %s", req.opcode,
+			resp.vbucket, string(resp.value))
+	}
+
+	return resp, nil
+}
+
+func openDcpConn(addr, username, password, bucket string) (*dcpConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	c := &dcpConn{conn: conn, reader: bufio.NewReader(conn)}
+
+	auth := []byte("\x00" + username + "\x00" + password)
+	if _, err := c.request(&mcPacket{opcode: mcSaslAuth, key: []byte("PLAIN"),
+		value: auth}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	if _, err := c.request(&mcPacket{opcode: mcSelectBucket, key: []byte(bucket)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	// Open a producer connection
+	extras := make([]byte, 8)
+	binary.BigEndian.PutUint32(extras[4:8], 0x01)
+	name := "backuptests-snapshot-" + strconv.FormatInt(time.Now().UnixNano(), 10)
+	if _, err := c.request(&mcPacket{opcode: mcDcpOpen, extras: extras,
+		key: []byte(name)}); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// streamVBuckets streams the given vbuckets from a single node and applies
+// every mutation, deletion and expiration to the snapshot.
+func streamVBuckets(addr, username, password, bucket string, vbuckets []uint16,
+	snapshot docSnapshot) error {
+	c, err := openDcpConn(addr, username, password, bucket)
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	state := make([]byte, 4)
+	binary.BigEndian.PutUint32(state, 0x01)
+	resp, err := c.request(&mcPacket{opcode: mcGetAllVBSeqnos, extras: state})
+	if err != nil {
+		return err
+	}
+
+	high := make(map[uint16]uint64)
+	for i := 0; i+10 <= len(resp.value); i += 10 {
+		vb := binary.BigEndian.Uint16(resp.value[i : i+2])
+		high[vb] = binary.BigEndian.Uint64(resp.value[i+2 : i+10])
+	}
+
+	open := 0
+	for _, vb := range vbuckets {
+		if high[vb] == 0 {
+			continue
+		}
+
+		extras := make([]byte, 48)
+		binary.BigEndian.PutUint64(extras[16:24], high[vb])
+		req := &mcPacket{magic: mcReqMagic, opcode: mcDcpStreamReq, vbucket: vb,
+			opaque: uint32(vb), extras: extras}
+		if _, err := c.conn.Write(req.bytes()); err != nil {
+			return err
+		}
+		open++
+	}
+
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Minute))
+	for open > 0 {
+		msg, err := readPacket(c.reader)
+		if err != nil {
+			return err
+		}
+
+		switch msg.opcode {
+		case mcDcpStreamReq:
+			if msg.vbucket != mcStatusSuccess {
+				return fmt.Errorf("Stream request for vbucket %d failed with status 0x%02x",
+					msg.opaque, msg.vbucket)
+			}
+		case mcDcpMutation:
+			// Documents that have expired but not yet been purged aren't live
+			expiry := binary.BigEndian.Uint32(msg.extras[20:24])
+			if expiry != 0 && int64(expiry) <= time.Now().Unix() {
+				delete(snapshot, string(msg.key))
+				continue
+			}
+
+			snapshot[string(msg.key)] = docMeta{
+				Key:      string(msg.key),
+				Value:    msg.value,
+				Flags:    binary.BigEndian.Uint32(msg.extras[16:20]),
+				Expiry:   expiry,
+				Datatype: msg.datatype,
+				Cas:      msg.cas,
+				RevSeqno: binary.BigEndian.Uint64(msg.extras[8:16]),
+			}
+		case mcDcpDeletion, mcDcpExpiration:
+			delete(snapshot, string(msg.key))
+		case mcDcpStreamEnd:
+			open--
+		case mcDcpNoop:
+			c.conn.Write((&mcPacket{magic: mcResMagic, opcode: mcDcpNoop,
+				opaque: msg.opaque}).bytes())
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,127 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+	"testing"
+
+	"github.com/couchbase/backup/storage"
+)
+
+// The storage config variant every storage test runs under.
+const defaultStorageVariant = "default"
+
+// storageConfigWith returns the default storage config with the JSON
+// overrides applied. Overrides naming fields the storage config does not have
+// are rejected so that a typo does not silently test the defaults.
+func storageConfigWith(overrides json.RawMessage) (*storage.StorageConfig, error) {
+	config := storage.DefaultStorageConfig()
+	if len(overrides) == 0 {
+		return config, nil
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(overrides))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(config); err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// storageVariant is a storage config variant that every storage test runs
+// under in addition to the default.
+type storageVariant struct {
+	name string
+	// Why the variant is worth running, which is what a failure under it is
+	// most likely to mean
+	reason    string
+	overrides string
+}
+
+// The built-in storage config variants. Each changes a single setting of the
+// default config so that a failure points straight at the setting
+// responsible. Settings are named as in storage.StorageConfig, and any that
+// it does not have are caught by TestBuiltinStorageConfigs.
+var builtinStorageVariants = []storageVariant{
+	{
+		name:      "small-files",
+		reason:    "rolls data over into a new file every megabyte, so that reads span files",
+		overrides: `{"MaxFileSize": 1048576}`,
+	},
+	{
+		name:      "large-files",
+		reason:    "keeps every vbucket of a backup in a single file",
+		overrides: `{"MaxFileSize": 4294967296}`,
+	},
+	{
+		name:      "no-sync",
+		reason:    "leaves syncing to the OS, so that nothing relies on a sync per write",
+		overrides: `{"SyncWrites": false}`,
+	},
+	{
+		name:      "small-buffer-cache",
+		reason:    "evicts blocks constantly, so that reads go to disk",
+		overrides: `{"BufferCacheSize": 1048576}`,
+	},
+	{
+		name:      "small-wal",
+		reason:    "flushes the write ahead log every 64 documents",
+		overrides: `{"WalThreshold": 64}`,
+	},
+}
+
+// builtinStorageConfigs returns the overrides of the built-in storage config
+// variants keyed by variant name.
+func builtinStorageConfigs() map[string]json.RawMessage {
+	variants := make(map[string]json.RawMessage, len(builtinStorageVariants))
+	for _, variant := range builtinStorageVariants {
+		variants[variant.name] = json.RawMessage(variant.overrides)
+	}
+
+	return variants
+}
+
+// storageConfigs returns the overrides of every storage config variant to
+// test. Variants from the test config are added to the built-in ones and
+// replace any built-in variant of the same name.
+func storageConfigs() map[string]json.RawMessage {
+	configs := builtinStorageConfigs()
+	for name, overrides := range testCfg.StorageConfigs {
+		configs[name] = overrides
+	}
+
+	return configs
+}
+
+// storageVariants returns the names of the storage config variants to test,
+// starting with the default.
+func storageVariants() []string {
+	configs := storageConfigs()
+
+	names := make([]string, 0, len(configs))
+	for name := range configs {
+		if name != defaultStorageVariant {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	return append([]string{defaultStorageVariant}, names...)
+}
+
+// forEachStorageConfig runs fn as a parallel subtest under every storage
+// config variant.
+func forEachStorageConfig(t *testing.T, fn func(t *testing.T, config *storage.StorageConfig)) {
+	configs := storageConfigs()
+	for _, name := range storageVariants() {
+		overrides := configs[name]
+		t.Run(name, func(t *testing.T) {
+			t.Parallel()
+			config, err := storageConfigWith(overrides)
+			checkError(err, t)
+			fn(t, config)
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+	"github.com/couchbase/backup/plan"
+	"github.com/couchbase/backup/storage"
+)
+
+// Runs a backup, incremental backup, merge and restore under every storage
+// config variant and checks that each produces the same logical result.
+func TestStorageConfigVariants(t *testing.T) {
+	forEachStorageConfig(t, func(t *testing.T, sc *storage.StorageConfig) {
+		env := newTestEnv(t, "default")
+		bucket := env.bucket("default", t)
+		createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+		backupName := "storage-test"
+		compression := (string)(plan.COMPRESSION_POLICY_UNCHANGED)
+		model := newShadowModel()
+
+		config, err := newBackupConfig().WithIncludeBuckets(env.bucketNames()...).Build()
+		checkError(err, t)
+
+		a, err := archive.MountArchive(env.archive, true)
+		checkError(err, t)
+
+		checkError(a.CreateRepo(backupName, config), t)
+
+		// Do full backup
+		model.loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 5000, "full",
+			false, t)
+
+		name1, err := executeConfiguredBackup(a, backupName, "archive", testCfg.Host,
+			testCfg.Username, testCfg.Password, compression, sc, 4, false, false)
+		checkError(err, t)
+		model.backup(name1)
+
+		// Do incremental backup with both mutations and deletions
+		model.loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 3000, "incr",
+			false, t)
+		model.loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "full",
+			true, t)
+
+		name2, err := executeConfiguredBackup(a, backupName, "archive", testCfg.Host,
+			testCfg.Username, testCfg.Password, compression, sc, 4, false, false)
+		checkError(err, t)
+		model.backup(name2)
+
+		expected := takeSnapshot(testCfg.Host, bucket, t)
+
+		for _, name := range []string{name1, name2} {
+			info, err := a.BackupInfo(backupName, name)
+			checkError(err, t)
+
+			count := info[bucket].NumDocs
+			if docs := model.backupDocs(bucket, name, t); count != docs {
+				t.Fatalf("Expected to backup %d items in %s, got %d", docs, name, count)
+			}
+			model.verifyBackup(a, backupName, name, bucket, t)
+		}
+
+		// Merge the backups
+		_, err = a.MergeIncrBackups(backupName, name1, name2, sc)
+		checkError(err, t)
+		model.merge(name1, name2, t)
+
+		info, err := a.BackupInfo(backupName, name2)
+		checkError(err, t)
+
+		count := info[bucket].NumDocs
+		if docs := model.backupDocs(bucket, name2, t); count != docs {
+			t.Fatalf("Expected merged backup to contain %d items, got %d", docs, count)
+		}
+		model.verifyBackup(a, backupName, name2, bucket, t)
+
+		verifyBackupContents(a, backupName, name2, bucket, expected,
+			verifyOptions{CheckCas: true, CheckRevision: true}, t)
+
+		rinfo, err := a.RepoInfo(backupName)
+		checkError(err, t)
+		if rinfo.NumBackups != 1 {
+			t.Fatalf("Expected 1 backup after merge, got %d", rinfo.NumBackups)
+		}
+
+		// Restore the merged backup
+		deleteBucket(testCfg.Host, bucket, t, true)
+		createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+		err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password,
+			"", "", 4, false, config)
+		checkError(err, t)
+
+		waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket,
+			model.restoredItems(bucket, "", "", t), t)
+		model.verifyRestore(testCfg.Host, bucket, "", "", t)
+		verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+	})
+}
@@ -0,0 +1,351 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests that restored documents keep the absolute expiry they had when they
+// were backed up, rather than having their TTL applied again from the time of
+// the restore.
+func TestBackupRestoreExpiry(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "expiry-test"
+	model := newShadowModel()
+
+	model.bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, "relative",
+		loadOptions{Mode: loadInsert, Expiry: rangedTTL(time.Hour, 2*time.Hour)}, t)
+	model.bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "absolute",
+		loadOptions{Mode: loadInsert, Expiry: expiresAt(time.Now().Add(3 * time.Hour))}, t)
+	model.loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "forever",
+		false, t)
+
+	loaded, err := clusterTime(testCfg.Host)
+	checkError(err, t)
+
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+	for key, doc := range expected {
+		if expires := !strings.HasPrefix(key, "forever"); expires != (doc.Expiry != 0) {
+			t.Fatalf("Document %s has unexpected expiry %d", key, doc.Expiry)
+		}
+	}
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	name, err := executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+	model.backup(name)
+	model.verifyBackup(a, backupName, name, bucket, t)
+
+	// Make sure a TTL applied again at restore time would give a different expiry
+	waitForClusterTime(testCfg.Host, loaded, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 2000, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+	model.verifyRestore(testCfg.Host, bucket, "", "", t)
+}
+
+// Tests that documents which expired before the backup are not backed up as
+// live documents and so are not brought back by the restore.
+func TestBackupExpiredDocuments(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "expired-backup-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "live", false, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "expiring",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(2 * time.Second)}, t)
+
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+	for key := range expected {
+		if strings.HasPrefix(key, "expiring") {
+			delete(expected, key)
+		}
+	}
+
+	// Wait for the documents to expire. The data service only removes expired
+	// documents lazily, so they are still on disk when the backup runs
+	waitForLiveDocs(testCfg.Host, bucket, 500, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForLiveDocs(testCfg.Host, bucket, 500, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
+
+// Tests that documents which were live when backed up but have expired by the
+// time of the restore stay expired, unless the restore is asked to replace the
+// TTLs of expired documents.
+func TestRestoreExpiredDocuments(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "expired-restore-test"
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "live", false, t)
+	expires := time.Now().Add(5 * time.Second)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "expiring",
+		loadOptions{Mode: loadInsert, Expiry: expiresAt(expires)}, t)
+	backedUp := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	if len(backedUp) != 1000 {
+		t.Fatalf("Expected 1000 live documents at the time of the backup, got %d",
+			len(backedUp))
+	}
+
+	// Wait for the documents to expire
+	waitForLiveDocs(testCfg.Host, bucket, 500, t)
+
+	live := make(docSnapshot)
+	for key, doc := range backedUp {
+		if strings.HasPrefix(key, "live") {
+			live[key] = doc
+		}
+	}
+
+	// The expired documents are restored with an expiry in the past
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForLiveDocs(testCfg.Host, bucket, 500, t)
+	verifyBucketContents(testCfg.Host, bucket, live, verifyOptions{}, t)
+
+	// Replacing the TTLs of expired documents brings them back
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	opts := restoreOptions{ReplaceTTL: replaceTTLExpired, ReplaceTTLWith: expiry}
+	err = executeRestoreWithOptions(a, backupName, testCfg.Host, testCfg.Username,
+		testCfg.Password, opts, config)
+	checkError(err, t)
+
+	revived := make(docSnapshot)
+	for key, doc := range backedUp {
+		if strings.HasPrefix(key, "expiring") {
+			doc.Expiry = uint32(expiry)
+		}
+		revived[key] = doc
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1000, t)
+	verifyBucketContents(testCfg.Host, bucket, revived, verifyOptions{}, t)
+}
+
+// Tests that the expiries given to documents by a bucket max TTL are backed up
+// and restored as they were, whether or not the bucket restored into has a
+// max TTL of its own.
+func TestBackupRestoreBucketMaxTTL(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+
+	maxTTL := time.Hour
+	createMaxTTLBucket(testCfg.Host, bucket, maxTTL, t)
+
+	backupName := "max-ttl-test"
+
+	loaded := time.Now()
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "forever", false, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "long",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(2 * maxTTL)}, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "short",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(10 * time.Minute)}, t)
+	done := time.Now()
+
+	// Documents without a TTL, or with one longer than the max TTL, are capped to
+	// the max TTL while shorter TTLs are left alone
+	expected := takeSnapshot(testCfg.Host, bucket, t)
+	for key, doc := range expected {
+		limit := maxTTL
+		if strings.HasPrefix(key, "short") {
+			limit = 10 * time.Minute
+		}
+		requireExpiryWithin(doc, loaded.Add(limit), done.Add(limit), t)
+	}
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	// Restoring the bucket config recreates the bucket with its max TTL
+	deleteBucket(testCfg.Host, bucket, t, true)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, config)
+	checkError(err, t)
+
+	waitForBucketHealthy(testCfg.Host, bucket, t)
+	settings := getBucketSettings(testCfg.Host, bucket, t)
+	if settings.MaxTTL != int(maxTTL.Seconds()) {
+		t.Fatalf("Expected restored bucket to have a max TTL of %d, got %d",
+			int(maxTTL.Seconds()), settings.MaxTTL)
+	}
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1500, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+
+	// Restoring into a bucket without a max TTL keeps the capped expiries
+	restoreConfig, err := newBackupConfig().
+		WithIncludeBuckets(bucket).
+		DisableBucketConfig().
+		Build()
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1500, t)
+	verifyBucketContents(testCfg.Host, bucket, expected, verifyOptions{}, t)
+}
+
+// Tests restoring documents that never expire, or that expire after the max
+// TTL, into a bucket with a max TTL. The restore writes them like any other
+// mutation, so the max TTL caps them to expire max TTL after the restore while
+// documents that expire sooner keep their expiry.
+func TestRestoreIntoBucketMaxTTL(t *testing.T) {
+	t.Parallel()
+	env := newTestEnv(t, "default")
+	bucket := env.bucket("default", t)
+	createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+	backupName := "restore-max-ttl-test"
+	maxTTL := time.Hour
+
+	loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "forever", false, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "long",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(2 * maxTTL)}, t)
+	bulkLoad(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "short",
+		loadOptions{Mode: loadInsert, Expiry: fixedTTL(10 * time.Minute)}, t)
+	backedUp := takeSnapshot(testCfg.Host, bucket, t)
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(env.archive, true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	restoreConfig, err := newBackupConfig().
+		WithIncludeBuckets(bucket).
+		DisableBucketConfig().
+		Build()
+	checkError(err, t)
+
+	deleteBucket(testCfg.Host, bucket, t, true)
+	createMaxTTLBucket(testCfg.Host, bucket, maxTTL, t)
+
+	started := time.Now()
+	err = executeRestore(a, backupName, testCfg.Host, testCfg.Username, testCfg.Password, "",
+		"", 4, false, restoreConfig)
+	checkError(err, t)
+	done := time.Now()
+
+	waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 1500, t)
+
+	actual := takeSnapshot(testCfg.Host, bucket, t)
+	diff := compareSnapshots(backedUp, actual, verifyOptions{IgnoreExpiry: true})
+	if !diff.Empty() {
+		t.Fatalf("Contents of bucket %s do not match: %s", bucket, diff.String())
+	}
+
+	for key, doc := range actual {
+		if strings.HasPrefix(key, "short") {
+			if doc.Expiry != backedUp[key].Expiry {
+				t.Fatalf("Document %s expires at %d, expected it to keep expiry %d", key,
+					doc.Expiry, backedUp[key].Expiry)
+			}
+			continue
+		}
+		requireExpiryWithin(doc, started.Add(maxTTL), done.Add(maxTTL), t)
+	}
+}
+
+// requireExpiryWithin fails the test unless the document expires between the
+// two times, give or take a second for the data service's clock granularity.
+func requireExpiryWithin(doc docMeta, earliest, latest time.Time, t *testing.T) {
+	t.Helper()
+
+	from := uint32(earliest.Unix()) - 1
+	to := uint32(latest.Unix()) + 1
+	if doc.Expiry < from || doc.Expiry > to {
+		t.Fatalf("Document %s expires at %d, expected between %d and %d", doc.Key, doc.Expiry,
+			from, to)
+	}
+}
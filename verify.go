@@ -0,0 +1,195 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+// Datatype bit set when a document value is snappy compressed.
+const datatypeSnappy = 0x02
+
+// Maximum number of entries of each kind printed in a diff report.
+const maxDiffReport = 20
+
+// verifyOptions controls which metadata compareSnapshots checks. Keys,
+// bodies, flags, expiry and datatype are always compared.
+type verifyOptions struct {
+	CheckCas      bool
+	CheckRevision bool
+	IgnoreExpiry  bool
+}
+
+type docMismatch struct {
+	Key      string
+	Field    string
+	Expected string
+	Actual   string
+}
+
+// docDiff describes the differences between an expected and an actual set of
+// documents.
+type docDiff struct {
+	Missing    []string
+	Extra      []string
+	Mismatched []docMismatch
+}
+
+func (d *docDiff) Empty() bool {
+	return len(d.Missing) == 0 && len(d.Extra) == 0 && len(d.Mismatched) == 0
+}
+
+func (d *docDiff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "%d missing, %d extra, %d mismatched", len(d.Missing), len(d.Extra),
+		len(d.Mismatched))
+
+	writeKeys := func(kind string, keys []string) {
+		for i, key := range keys {
+			if i == maxDiffReport {
+				fmt.Fprintf(&b, "\n  ... %d more %s", len(keys)-i, kind)
+				break
+			}
+			fmt.Fprintf(&b, "\n  %s: %s", kind, key)
+		}
+	}
+
+	writeKeys("missing", d.Missing)
+	writeKeys("extra", d.Extra)
+
+	for i, m := range d.Mismatched {
+		if i == maxDiffReport {
+			fmt.Fprintf(&b, "\n  ... %d more mismatched", len(d.Mismatched)-i)
+			break
+		}
+		fmt.Fprintf(&b, "\n  mismatched %s: %s expected %s, got %s", m.Key, m.Field,
+			m.Expected, m.Actual)
+	}
+
+	return b.String()
+}
+
+// compareSnapshots diffs two sets of documents.
+func compareSnapshots(expected, actual docSnapshot, opts verifyOptions) *docDiff {
+	diff := &docDiff{
+		Missing:    make([]string, 0),
+		Extra:      make([]string, 0),
+		Mismatched: make([]docMismatch, 0),
+	}
+
+	for key, exp := range expected {
+		act, ok := actual[key]
+		if !ok {
+			diff.Missing = append(diff.Missing, key)
+			continue
+		}
+
+		mismatch := func(field string, e, a interface{}) {
+			diff.Mismatched = append(diff.Mismatched, docMismatch{key, field,
+				fmt.Sprintf("%v", e), fmt.Sprintf("%v", a)})
+		}
+
+		if !sameBody(exp, act) {
+			mismatch("body", string(exp.Value), string(act.Value))
+		}
+		if exp.Flags != act.Flags {
+			mismatch("flags", exp.Flags, act.Flags)
+		}
+		if !opts.IgnoreExpiry && exp.Expiry != act.Expiry {
+			mismatch("expiry", exp.Expiry, act.Expiry)
+		}
+		if exp.Datatype&^datatypeSnappy != act.Datatype&^datatypeSnappy {
+			mismatch("datatype", exp.Datatype, act.Datatype)
+		}
+		if opts.CheckCas && exp.Cas != act.Cas {
+			mismatch("cas", exp.Cas, act.Cas)
+		}
+		if opts.CheckRevision && exp.RevSeqno != act.RevSeqno {
+			mismatch("revision", exp.RevSeqno, act.RevSeqno)
+		}
+	}
+
+	for key := range actual {
+		if _, ok := expected[key]; !ok {
+			diff.Extra = append(diff.Extra, key)
+		}
+	}
+
+	sort.Strings(diff.Missing)
+	sort.Strings(diff.Extra)
+	sort.Slice(diff.Mismatched, func(i, j int) bool {
+		if diff.Mismatched[i].Key != diff.Mismatched[j].Key {
+			return diff.Mismatched[i].Key < diff.Mismatched[j].Key
+		}
+		return diff.Mismatched[i].Field < diff.Mismatched[j].Field
+	})
+
+	return diff
+}
+
+// sameBody compares document bodies. Snappy compressed bodies are compared
+// by their decompressed value and JSON documents are compared structurally so
+// that insignificant whitespace differences are ignored.
+func sameBody(a, b docMeta) bool {
+	av, aok := decodedBody(a)
+	bv, bok := decodedBody(b)
+	if !aok || !bok {
+		return false
+	}
+
+	if bytes.Equal(av, bv) {
+		return true
+	}
+
+	var aj, bj interface{}
+	if json.Unmarshal(av, &aj) != nil || json.Unmarshal(bv, &bj) != nil {
+		return false
+	}
+	return reflect.DeepEqual(aj, bj)
+}
+
+// decodedBody returns the uncompressed body of a document, or false if the
+// document claims to be snappy compressed but isn't.
+func decodedBody(doc docMeta) ([]byte, bool) {
+	if doc.Datatype&datatypeSnappy == 0 {
+		return doc.Value, true
+	}
+
+	value, err := snappy.Decode(nil, doc.Value)
+	return value, err == nil
+}
+
+// verifyBucketContents snapshots the bucket and fails the test if it differs
+// from the expected documents.
+func verifyBucketContents(host, bucket string, expected docSnapshot, opts verifyOptions,
+	t *testing.T) {
+	t.Helper()
+
+	actual, err := snapshotBucket(host, testCfg.Username, testCfg.Password, bucket)
+	if err != nil {
+		t.Fatalf("Unable to read the contents of bucket %s: %s", bucket, err.Error())
+	}
+
+	if diff := compareSnapshots(expected, actual, opts); !diff.Empty() {
+		t.Fatalf("Contents of bucket %s do not match: %s", bucket, diff.String())
+	}
+}
+
+// takeSnapshot reads the contents of a bucket, failing the test on error. Tests
+// take a snapshot of the source bucket just before a backup and verify the
+// restored bucket against it.
+func takeSnapshot(host, bucket string, t *testing.T) docSnapshot {
+	t.Helper()
+
+	snapshot, err := snapshotBucket(host, testCfg.Username, testCfg.Password, bucket)
+	if err != nil {
+		t.Fatalf("Unable to read the contents of bucket %s: %s", bucket, err.Error())
+	}
+	return snapshot
+}
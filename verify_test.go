@@ -0,0 +1,75 @@
+package tests
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/golang/snappy"
+)
+
+func TestVerifyBucketContents(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+
+	store := mc.bucketStore("default")
+	for _, key := range []string{"a", "b", "c"} {
+		store.store(mcSet, store.vbucketForKey(key), key, []byte(`{"k": "`+key+`"}`), 0, 0,
+			0x01, 0)
+	}
+
+	expected := takeSnapshot(mc.URL(), "default", t)
+	if len(expected) != 3 {
+		t.Fatalf("Expected snapshot of 3 documents, got %d", len(expected))
+	}
+
+	verifyBucketContents(mc.URL(), "default", expected, verifyOptions{CheckCas: true,
+		CheckRevision: true}, t)
+
+	// Whitespace differences in JSON bodies are not mismatches
+	store.store(mcSet, store.vbucketForKey("a"), "a", []byte(`{"k":"a"}`), 0, 0, 0x01, 0)
+	store.store(mcSet, store.vbucketForKey("b"), "b", []byte(`{"k": "b"}`), 7, 0, 0x01, 0)
+	store.remove(store.vbucketForKey("c"), "c", 0)
+	store.store(mcSet, store.vbucketForKey("d"), "d", []byte(`{}`), 0, 0, 0x01, 0)
+
+	actual := takeSnapshot(mc.URL(), "default", t)
+	diff := compareSnapshots(expected, actual, verifyOptions{})
+
+	if len(diff.Missing) != 1 || diff.Missing[0] != "c" {
+		t.Fatalf("Expected `c` to be missing, got %v", diff.Missing)
+	}
+	if len(diff.Extra) != 1 || diff.Extra[0] != "d" {
+		t.Fatalf("Expected `d` to be extra, got %v", diff.Extra)
+	}
+	if len(diff.Mismatched) != 1 || diff.Mismatched[0].Key != "b" ||
+		diff.Mismatched[0].Field != "flags" {
+		t.Fatalf("Expected flags of `b` to mismatch, got %s", diff.String())
+	}
+
+	diff = compareSnapshots(expected, actual, verifyOptions{CheckCas: true})
+	if len(diff.Mismatched) != 3 {
+		t.Fatalf("Expected CAS of `a` and `b` and flags of `b` to mismatch, got %s",
+			diff.String())
+	}
+}
+
+func TestCompareSnappyBodies(t *testing.T) {
+	body := []byte(`{"k": "` + strings.Repeat("a", 128) + `"}`)
+	compressed := snappy.Encode(nil, body)
+
+	expected := docSnapshot{"a": docMeta{Key: "a", Value: body, Datatype: 0x01}}
+	actual := docSnapshot{"a": docMeta{Key: "a", Value: compressed,
+		Datatype: 0x01 | datatypeSnappy}}
+
+	if diff := compareSnapshots(expected, actual, verifyOptions{}); !diff.Empty() {
+		t.Fatalf("Expected compressed body to match its original, got %s", diff.String())
+	}
+
+	actual["a"] = docMeta{Key: "a", Value: snappy.Encode(nil, []byte(`{"k": "b"}`)),
+		Datatype: 0x01 | datatypeSnappy}
+	diff := compareSnapshots(expected, actual, verifyOptions{})
+	if len(diff.Mismatched) != 1 || diff.Mismatched[0].Field != "body" {
+		t.Fatalf("Expected body of `a` to mismatch, got %s", diff.String())
+	}
+}
@@ -0,0 +1,172 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/couchbase/backup/couchbase"
+	"github.com/couchbase/backup/value"
+)
+
+// designDocs are the bodies of design documents keyed by id, for example
+// _design/name or _design/dev_name for development design documents.
+type designDocs map[string]interface{}
+
+// generatedDDocs returns design documents prefix_0 to prefix_<numDDocs-1>, each
+// with numViews views. Every view emits its own number so that views which are
+// swapped or merged by a round trip can be told apart.
+func generatedDDocs(prefix string, numDDocs, numViews int) designDocs {
+	ddocs := make(designDocs)
+
+	for i := 0; i < numDDocs; i++ {
+		dname := "_design/" + prefix + "_" + strconv.Itoa(i)
+		views := make(map[string]map[string]map[string]string)
+		views["views"] = make(map[string]map[string]string)
+
+		for j := 0; j < numViews; j++ {
+			vname := "generated_views_" + strconv.Itoa(j)
+			views["views"][vname] = make(map[string]string)
+			views["views"][vname]["map"] = "function (doc, meta) {\n emit(meta.id, " +
+				strconv.Itoa(j) + ");\n}"
+		}
+
+		ddocs[dname] = views
+	}
+
+	return ddocs
+}
+
+// putDesignDocs creates, or replaces, the design documents in the bucket.
+func putDesignDocs(host, bucket string, ddocs designDocs, t *testing.T) {
+	rest := couchbase.CreateRestClient(host, testCfg.Username, testCfg.Password, nil)
+
+	ids := make([]string, 0, len(ddocs))
+	for id := range ddocs {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	views := make([]value.DDoc, 0, len(ids))
+	for _, id := range ids {
+		views = append(views, value.DDoc{id, "xxxxx", ddocs[id]})
+	}
+
+	checkError(rest.PutViews(bucket, views), t)
+}
+
+// getDesignDocs reads every design document in the bucket straight from the
+// cluster manager so that the result doesn't depend on the rest client under
+// test.
+func getDesignDocs(host, bucket string, t *testing.T) designDocs {
+	req, err := http.NewRequest("GET", host+"/pools/default/buckets/"+bucket+"/ddocs", nil)
+	checkError(err, t)
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	checkError(err, t)
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Getting design documents of bucket %s returned %d", bucket, resp.StatusCode)
+	}
+
+	type overlay struct {
+		Rows []struct {
+			Doc struct {
+				Meta struct {
+					ID string `json:"id"`
+				} `json:"meta"`
+				JSON interface{} `json:"json"`
+			} `json:"doc"`
+		} `json:"rows"`
+	}
+
+	var data overlay
+	checkError(json.NewDecoder(resp.Body).Decode(&data), t)
+
+	ddocs := make(designDocs)
+	for _, row := range data.Rows {
+		ddocs[row.Doc.Meta.ID] = row.Doc.JSON
+	}
+
+	return ddocs
+}
+
+// verifyDesignDocs fails the test if the design documents in the bucket differ
+// from the expected design documents in any way, including their views, map
+// and reduce functions, spatial functions and options.
+func verifyDesignDocs(host, bucket string, expected designDocs, t *testing.T) {
+	t.Helper()
+
+	actual := getDesignDocs(host, bucket, t)
+
+	diffs := make([]string, 0)
+	for id, body := range expected {
+		got, ok := actual[id]
+		if !ok {
+			diffs = append(diffs, fmt.Sprintf("%s is missing", id))
+			continue
+		}
+
+		// Compare the expected body as it would be read back from the cluster
+		data, err := json.Marshal(body)
+		checkError(err, t)
+
+		var want interface{}
+		checkError(json.Unmarshal(data, &want), t)
+
+		diffs = append(diffs, jsonDiff(id, want, got)...)
+	}
+
+	for id := range actual {
+		if _, ok := expected[id]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s", id))
+		}
+	}
+
+	if len(diffs) > 0 {
+		sort.Strings(diffs)
+		if len(diffs) > maxDiffReport {
+			diffs = append(diffs[:maxDiffReport],
+				fmt.Sprintf("and %d more", len(diffs)-maxDiffReport))
+		}
+		t.Fatalf("Design documents of bucket %s do not match: %s", bucket,
+			strings.Join(diffs, ", "))
+	}
+}
+
+// jsonDiff returns a description of every difference between two decoded JSON
+// values, naming each by its path.
+func jsonDiff(path string, expected, actual interface{}) []string {
+	expObj, expIsObj := expected.(map[string]interface{})
+	actObj, actIsObj := actual.(map[string]interface{})
+	if !expIsObj || !actIsObj {
+		if reflect.DeepEqual(expected, actual) {
+			return nil
+		}
+		return []string{fmt.Sprintf("%s expected %v, got %v", path, expected, actual)}
+	}
+
+	diffs := make([]string, 0)
+	for key, value := range expObj {
+		if other, ok := actObj[key]; ok {
+			diffs = append(diffs, jsonDiff(path+"."+key, value, other)...)
+		} else {
+			diffs = append(diffs, fmt.Sprintf("%s.%s is missing", path, key))
+		}
+	}
+
+	for key := range actObj {
+		if _, ok := expObj[key]; !ok {
+			diffs = append(diffs, fmt.Sprintf("unexpected %s.%s", path, key))
+		}
+	}
+
+	return diffs
+}
@@ -0,0 +1,140 @@
+package tests
+
+import (
+	"testing"
+
+	"github.com/couchbase/backup/archive"
+)
+
+// Tests restoring into a bucket that already has design documents, some with
+// the same names as the backed up design documents but different views and
+// some that are not in the backup. Backed up design documents replace the
+// existing ones of the same name whether or not updates are forced, design
+// documents that are not in the backup are left alone and nothing is touched
+// when views are excluded from the restore.
+func TestRestoreViewsIntoExistingDDocs(t *testing.T) {
+	cases := []struct {
+		name         string
+		force        bool
+		disableViews bool
+	}{
+		{name: "Default"},
+		{name: "Force", force: true},
+		{name: "ViewsDisabled", disableViews: true},
+		{name: "ViewsDisabledForce", force: true, disableViews: true},
+	}
+
+	for _, c := range cases {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			t.Parallel()
+			env := newTestEnv(t, "default")
+			bucket := env.bucket("default", t)
+			createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+			backupName := "ddoc-conflict-test"
+
+			loadData(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, "ddoc",
+				false, t)
+			backedUp := loadViews(testCfg.Host, bucket, "shared", 3, 2, t)
+			expectedData := takeSnapshot(testCfg.Host, bucket, t)
+
+			config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+			checkError(err, t)
+
+			a, err := archive.MountArchive(env.archive, true)
+			checkError(err, t)
+
+			checkError(a.CreateRepo(backupName, config), t)
+
+			_, err = executeBackup(a, backupName, "archive", testCfg.Host, testCfg.Username,
+				testCfg.Password, 4, false, false)
+			checkError(err, t)
+
+			// Recreate the bucket with conflicting and unrelated design documents
+			deleteBucket(testCfg.Host, bucket, t, true)
+			createCouchbaseBucket(testCfg.Host, bucket, "", t)
+
+			conflicting := loadViews(testCfg.Host, bucket, "shared", 3, 4, t)
+			extra := loadViews(testCfg.Host, bucket, "extra", 2, 1, t)
+
+			builder := newBackupConfig().WithIncludeBuckets(bucket)
+			if c.disableViews {
+				builder.DisableViews()
+			}
+			restoreConfig, err := builder.Build()
+			checkError(err, t)
+
+			err = executeRestore(a, backupName, testCfg.Host, testCfg.Username,
+				testCfg.Password, "", "", 4, c.force, restoreConfig)
+			checkError(err, t)
+
+			expected := make(designDocs)
+			for id, body := range extra {
+				expected[id] = body
+			}
+
+			kept := backedUp
+			if c.disableViews {
+				kept = conflicting
+			}
+			for id, body := range kept {
+				expected[id] = body
+			}
+
+			verifyDesignDocs(testCfg.Host, bucket, expected, t)
+
+			waitForItemCount(testCfg.Host, testCfg.Username, testCfg.Password, bucket, 500, t)
+			verifyBucketContents(testCfg.Host, bucket, expectedData, verifyOptions{}, t)
+		})
+	}
+}
+
+// Tests that a restore fails, rather than carrying on, when the cluster
+// refuses a backed up design document. A real cluster can't be made to hold a
+// design document it refuses, so the malformed one is planted on a mock
+// cluster before the backup.
+func TestRestoreMalformedDDoc(t *testing.T) {
+	t.Parallel()
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	t.Cleanup(mc.Close)
+
+	host, bucket, backupName := mc.URL(), "default", "ddoc-malformed-test"
+	createCouchbaseBucket(host, bucket, "", t)
+
+	loadData(host, testCfg.Username, testCfg.Password, bucket, 500, "ddoc", false, t)
+	loadViews(host, bucket, "good", 2, 1, t)
+	mc.putRawDDoc(bucket, "_design/broken", []byte(`{"views": {"v": {"map": "emit(1)"}}}`))
+
+	config, err := newBackupConfig().WithIncludeBuckets(bucket).Build()
+	checkError(err, t)
+
+	a, err := archive.MountArchive(t.TempDir(), true)
+	checkError(err, t)
+
+	checkError(a.CreateRepo(backupName, config), t)
+
+	_, err = executeBackup(a, backupName, "archive", host, testCfg.Username,
+		testCfg.Password, 4, false, false)
+	checkError(err, t)
+
+	deleteBucket(host, bucket, t, true)
+	createCouchbaseBucket(host, bucket, "", t)
+	extra := loadViews(host, bucket, "extra", 1, 1, t)
+
+	err = executeRestore(a, backupName, host, testCfg.Username, testCfg.Password, "", "", 4,
+		false, config)
+	if err == nil {
+		t.Fatal("Expected the restore to fail on the malformed design document")
+	}
+
+	actual := getDesignDocs(host, bucket, t)
+	if _, ok := actual["_design/broken"]; ok {
+		t.Fatal("Expected the malformed design document not to be restored")
+	}
+	for id := range extra {
+		if _, ok := actual[id]; !ok {
+			t.Fatalf("Expected existing design document %s to be left alone", id)
+		}
+	}
+}
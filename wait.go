@@ -0,0 +1,269 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/couchbase/backup/couchbase"
+)
+
+const (
+	defaultWaitTimeout = 60 * time.Second
+	minWaitInterval    = 50 * time.Millisecond
+	maxWaitInterval    = 2 * time.Second
+
+	// Time left before the test binary deadline to report a useful failure
+	// instead of being killed by the test runner.
+	deadlineGrace = 5 * time.Second
+)
+
+// waitCondition reports whether the awaited state has been reached along with
+// the value it observed, which is included in the failure message if the wait
+// times out.
+type waitCondition func() (bool, interface{}, error)
+
+// waitFor polls cond with exponential backoff until it succeeds or the
+// timeout expires. The timeout is cut short if the test binary has a deadline
+// that would expire first.
+func waitFor(what string, timeout time.Duration, t *testing.T, cond waitCondition) {
+	t.Helper()
+
+	start := time.Now()
+	deadline := start.Add(timeout)
+	if d, ok := t.Deadline(); ok && d.Add(-deadlineGrace).Before(deadline) {
+		deadline = d.Add(-deadlineGrace)
+	}
+
+	var observed interface{}
+	var lastErr error
+	attempts := 0
+	interval := minWaitInterval
+
+	for {
+		attempts++
+
+		var done bool
+		done, observed, lastErr = cond()
+		if done && lastErr == nil {
+			return
+		}
+
+		if time.Now().Add(interval).After(deadline) {
+			break
+		}
+
+		time.Sleep(interval)
+		interval *= 2
+		if interval > maxWaitInterval {
+			interval = maxWaitInterval
+		}
+	}
+
+	msg := fmt.Sprintf("Timed out after %s (%d attempts) waiting for %s, last observed: %v",
+		time.Since(start).Round(time.Millisecond), attempts, what, observed)
+	if lastErr != nil {
+		msg += ", last error: " + lastErr.Error()
+	}
+	t.Fatal(msg)
+}
+
+// waitForItemCount waits until the bucket reports exactly the expected number
+// of items.
+func waitForItemCount(host, username, password, bucket string, expected uint64,
+	t *testing.T) {
+	t.Helper()
+
+	what := fmt.Sprintf("%d items in bucket %s", expected, bucket)
+	waitFor(what, defaultWaitTimeout, t, func() (bool, interface{}, error) {
+		items, err := getNumItems(host, username, password, bucket)
+		if err != nil {
+			return false, nil, err
+		}
+		return items == expected, fmt.Sprintf("%d items", items), nil
+	})
+}
+
+// waitForLiveDocs waits until the bucket holds exactly the expected number of
+// live documents. Unlike the item count, which may include documents that have
+// expired but not yet been purged, this reads the documents themselves.
+func waitForLiveDocs(host, bucket string, expected int, t *testing.T) {
+	t.Helper()
+
+	what := fmt.Sprintf("%d live documents in bucket %s", expected, bucket)
+	waitFor(what, defaultWaitTimeout, t, func() (bool, interface{}, error) {
+		snapshot, err := snapshotBucket(host, testCfg.Username, testCfg.Password, bucket)
+		if err != nil {
+			return false, nil, err
+		}
+		return len(snapshot) == expected, fmt.Sprintf("%d live documents", len(snapshot)), nil
+	})
+}
+
+// waitForClusterTime waits until the clock of the cluster, as reported in the
+// Date header of its responses, is past the given time. The header is in whole
+// seconds, as are document expiries.
+func waitForClusterTime(host string, after time.Time, t *testing.T) {
+	t.Helper()
+
+	waitFor("cluster time to pass "+after.UTC().Format(http.TimeFormat), defaultWaitTimeout, t,
+		func() (bool, interface{}, error) {
+			now, err := clusterTime(host)
+			if err != nil {
+				return false, nil, err
+			}
+			return now.After(after), now.UTC().Format(http.TimeFormat), nil
+		})
+}
+
+// clusterTime returns the time on the cluster's clock, to the second.
+func clusterTime(host string) (time.Time, error) {
+	req, err := http.NewRequest("GET", host+"/pools", nil)
+	if err != nil {
+		return time.Time{}, err
+	}
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return time.Time{}, err
+	}
+	resp.Body.Close()
+
+	return http.ParseTime(resp.Header.Get("Date"))
+}
+
+// waitForBucketHealthy waits until the bucket exists and every node serving it
+// is healthy.
+func waitForBucketHealthy(host, bucket string, t *testing.T) {
+	t.Helper()
+
+	waitFor("bucket "+bucket+" to be healthy", 30*time.Second, t,
+		func() (bool, interface{}, error) {
+			statuses, err := bucketNodeStatus(host, bucket)
+			if err != nil {
+				return false, nil, err
+			} else if statuses == nil {
+				return false, "bucket not found", nil
+			}
+
+			for _, status := range statuses {
+				if status != "healthy" {
+					return false, fmt.Sprintf("node statuses %v", statuses), nil
+				}
+			}
+			return len(statuses) > 0, fmt.Sprintf("node statuses %v", statuses), nil
+		})
+}
+
+// waitForViewsPresent waits until the bucket has the expected number of design
+// documents.
+func waitForViewsPresent(host, bucket string, expected int, t *testing.T) {
+	t.Helper()
+
+	rest := couchbase.CreateRestClient(host, testCfg.Username, testCfg.Password, nil)
+
+	what := fmt.Sprintf("%d design documents in bucket %s", expected, bucket)
+	waitFor(what, defaultWaitTimeout, t, func() (bool, interface{}, error) {
+		views, err := rest.GetViews(bucket)
+		if err != nil {
+			return false, nil, err
+		}
+		return len(views) == expected, fmt.Sprintf("%d design documents", len(views)), nil
+	})
+}
+
+// waitForIndexesOnline waits until the bucket has the expected number of GSI
+// indexes and all of them are ready to serve queries.
+func waitForIndexesOnline(host, bucket string, expected int, t *testing.T) {
+	t.Helper()
+	waitForIndexes(host, bucket, expected, expected, t)
+}
+
+// waitForIndexes waits until the bucket has the expected number of GSI
+// indexes, of which the given number are ready to serve queries. Indexes with
+// deferred builds are not online until they have been built.
+func waitForIndexes(host, bucket string, expected, online int, t *testing.T) {
+	t.Helper()
+
+	what := fmt.Sprintf("%d indexes, %d online, in bucket %s", expected, online, bucket)
+	waitFor(what, defaultWaitTimeout, t, func() (bool, interface{}, error) {
+		statuses, err := indexStatus(host, bucket)
+		if err != nil {
+			return false, nil, err
+		}
+
+		ready := 0
+		for _, status := range statuses {
+			if status == "Ready" {
+				ready++
+			}
+		}
+
+		return ready == online && len(statuses) == expected,
+			fmt.Sprintf("index statuses %v", statuses), nil
+	})
+}
+
+// indexStatus returns the status of every GSI index on the bucket keyed by
+// index name.
+func indexStatus(host, bucket string) (map[string]string, error) {
+	indexes, err := getIndexes(host, bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	statuses := make(map[string]string)
+	for _, index := range indexes {
+		statuses[index.Index] = index.Status
+	}
+
+	return statuses, nil
+}
+
+type indexInfo struct {
+	Bucket     string `json:"bucket"`
+	Index      string `json:"index"`
+	Status     string `json:"status"`
+	Definition string `json:"definition"`
+}
+
+// getIndexes returns every GSI index on the bucket as reported by the cluster
+// manager.
+func getIndexes(host, bucket string) ([]indexInfo, error) {
+	req, err := http.NewRequest("GET", host+"/indexStatus", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(testCfg.Username, testCfg.Password)
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Getting index status returned %d", resp.StatusCode)
+	}
+
+	type overlay struct {
+		Indexes []indexInfo `json:"indexes"`
+	}
+
+	var data overlay
+	if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
+		return nil, err
+	}
+
+	indexes := make([]indexInfo, 0)
+	for _, index := range data.Indexes {
+		if index.Bucket == bucket {
+			indexes = append(indexes, index)
+		}
+	}
+
+	return indexes, nil
+}
@@ -0,0 +1,25 @@
+package tests
+
+import (
+	"testing"
+)
+
+func TestWaitHelpers(t *testing.T) {
+	mc := newMockCluster(testCfg.Username, testCfg.Password)
+	defer mc.Close()
+
+	createCouchbaseBucket(mc.URL(), "default", "", t)
+	waitForBucketHealthy(mc.URL(), "default", t)
+
+	store := mc.bucketStore("default")
+	for _, key := range []string{"a", "b", "c"} {
+		store.store(mcSet, store.vbucketForKey(key), key, []byte("{}"), 0, 0, 0, 0)
+	}
+
+	waitForItemCount(mc.URL(), testCfg.Username, testCfg.Password, "default", 3, t)
+
+	loadViews(mc.URL(), "default", "wait", 2, 1, t)
+	waitForViewsPresent(mc.URL(), "default", 2, t)
+
+	waitForIndexesOnline(mc.URL(), "default", 0, t)
+}